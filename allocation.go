@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Define a struct to represent a single line of an order
+type OrderLine struct {
+	SKUID     int
+	Category  string
+	Quantity  int
+	UnitPrice float64
+}
+
+// Total returns the undiscounted amount of the line
+func (l OrderLine) Total() float64 {
+	return fromCents(toCents(l.UnitPrice) * int64(l.Quantity))
+}
+
+// Define a struct to represent the share of an order-level discount held by one order line
+type LineAllocation struct {
+	LineNumber       int
+	SKUID            int
+	Quantity         int
+	LineAmount       float64
+	DiscountAmount   float64
+	ReturnedQuantity int
+}
+
+var ErrDiscountExceedsEligible = errors.New("discount exceeds the eligible order amount")
+
+// Convert a monetary amount to whole cents
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// Convert whole cents back to a monetary amount
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+// AllocateDiscount spreads an order-level discount across the eligible order lines
+// in proportion to their amounts. Lines are eligible when their SKU is listed in
+// eligibleSKUs, or always when eligibleSKUs is empty. Pennies lost to rounding go to
+// the lines with the largest remainders, ties broken by line order, so the same
+// order always produces the same allocation.
+func AllocateDiscount(discount float64, lines []OrderLine, eligibleSKUs []int) ([]LineAllocation, error) {
+	eligible := make(map[int]bool, len(eligibleSKUs))
+	for _, skuID := range eligibleSKUs {
+		eligible[skuID] = true
+	}
+
+	var allocations []LineAllocation
+	var lineCents []int64
+	var eligibleTotal int64
+	for i, line := range lines {
+		if len(eligible) > 0 && !eligible[line.SKUID] {
+			continue
+		}
+		cents := toCents(line.UnitPrice) * int64(line.Quantity)
+		if cents <= 0 {
+			continue
+		}
+		allocations = append(allocations, LineAllocation{
+			LineNumber: i + 1,
+			SKUID:      line.SKUID,
+			Quantity:   line.Quantity,
+			LineAmount: fromCents(cents),
+		})
+		lineCents = append(lineCents, cents)
+		eligibleTotal += cents
+	}
+
+	discountCents := toCents(discount)
+	if discountCents <= 0 || len(allocations) == 0 {
+		return allocations, nil
+	}
+	if discountCents > eligibleTotal {
+		return nil, fmt.Errorf("%w: %.2f > %.2f", ErrDiscountExceedsEligible, discount, fromCents(eligibleTotal))
+	}
+
+	shares := splitCents(discountCents, lineCents)
+	for i := range allocations {
+		allocations[i].DiscountAmount = fromCents(shares[i])
+	}
+	return allocations, nil
+}
+
+// splitCents divides total in proportion to weights. Every share is rounded down and
+// the pennies lost go to the largest remainders, ties broken by position.
+func splitCents(total int64, weights []int64) []int64 {
+	var weightTotal int64
+	for _, weight := range weights {
+		weightTotal += weight
+	}
+	shares := make([]int64, len(weights))
+	if weightTotal <= 0 {
+		return shares
+	}
+
+	// Give every weight its rounded-down share and remember what was cut off
+	remainders := make([]int64, len(weights))
+	var allocated int64
+	for i, weight := range weights {
+		shares[i] = total * weight / weightTotal
+		remainders[i] = total * weight % weightTotal
+		allocated += shares[i]
+	}
+
+	// Hand out the leftover pennies, largest remainder first
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := 0; allocated < total; i++ {
+		shares[order[i%len(order)]]++
+		allocated++
+	}
+	return shares
+}
+
+// reallocate spreads a new discount over existing allocations in proportion to their line amounts
+func reallocate(allocations []LineAllocation, discount float64) []LineAllocation {
+	weights := make([]int64, len(allocations))
+	for i, allocation := range allocations {
+		weights[i] = toCents(allocation.LineAmount)
+	}
+	shares := splitCents(toCents(discount), weights)
+
+	reallocated := make([]LineAllocation, len(allocations))
+	for i, allocation := range allocations {
+		allocation.DiscountAmount = fromCents(shares[i])
+		reallocated[i] = allocation
+	}
+	return reallocated
+}
+
+// ClawbackFor returns the discount to reclaim when quantity units of the line are
+// returned after previouslyReturned units were already refunded. Amounts are taken
+// from the cumulative share so repeated partial returns add up to the full allocation.
+func (a LineAllocation) ClawbackFor(previouslyReturned, quantity int) float64 {
+	if a.Quantity <= 0 || quantity <= 0 {
+		return 0
+	}
+	if previouslyReturned+quantity > a.Quantity {
+		quantity = a.Quantity - previouslyReturned
+	}
+	if quantity <= 0 {
+		return 0
+	}
+	allocated := toCents(a.DiscountAmount)
+	before := allocated * int64(previouslyReturned) / int64(a.Quantity)
+	after := allocated * int64(previouslyReturned+quantity) / int64(a.Quantity)
+	if previouslyReturned+quantity == a.Quantity {
+		after = allocated
+	}
+	return fromCents(after - before)
+}
+
+// Insert the line allocations of a coupon usage
+func insertUsageAllocations(tx *sql.Tx, usageID int, allocations []LineAllocation) error {
+	if len(allocations) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO CouponUsageAllocations (usage_id, line_number, sku_id, quantity, line_amount, discount_amount, returned_quantity) VALUES (?, ?, ?, ?, ?, ?, 0)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, allocation := range allocations {
+		_, err := stmt.Exec(usageID, allocation.LineNumber, allocation.SKUID, allocation.Quantity, allocation.LineAmount, allocation.DiscountAmount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retrieve the line allocations recorded for a coupon usage
+func GetCouponUsageAllocations(db *sql.DB, usageID int) ([]LineAllocation, error) {
+	rows, err := db.Query("SELECT line_number, sku_id, quantity, line_amount, discount_amount, returned_quantity FROM CouponUsageAllocations WHERE usage_id = ? ORDER BY line_number", usageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allocations []LineAllocation
+	for rows.Next() {
+		var allocation LineAllocation
+		if err := rows.Scan(&allocation.LineNumber, &allocation.SKUID, &allocation.Quantity, &allocation.LineAmount, &allocation.DiscountAmount, &allocation.ReturnedQuantity); err != nil {
+			return nil, err
+		}
+		allocations = append(allocations, allocation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// ClawbackReturnedUnits records that quantity units of an order line were returned and
+// returns the share of the coupon discount reclaimed for them. The clawback is recorded
+// as a partial reversal of the redemption, so it is given back to the campaign budget;
+// it is capped at the discount not reversed yet, and clawing back all of it completes
+// the reversal.
+func ClawbackReturnedUnits(db *sql.DB, usageID, lineNumber, quantity int) (float64, error) {
+	if quantity <= 0 {
+		return 0, fmt.Errorf("cannot return %d units of line %d: the quantity must be positive", quantity, lineNumber)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	usage, err := lockUsageForReversal(tx, usageID)
+	if err != nil {
+		return 0, err
+	}
+	if usage.Status != UsageStatusRedeemed {
+		return 0, ErrUsageNotRedeemed
+	}
+
+	var allocation LineAllocation
+	err = tx.QueryRow("SELECT line_number, sku_id, quantity, line_amount, discount_amount, returned_quantity FROM CouponUsageAllocations WHERE usage_id = ? AND line_number = ? FOR UPDATE",
+		usageID, lineNumber).Scan(&allocation.LineNumber, &allocation.SKUID, &allocation.Quantity, &allocation.LineAmount, &allocation.DiscountAmount, &allocation.ReturnedQuantity)
+	if err != nil {
+		return 0, err
+	}
+	if allocation.ReturnedQuantity+quantity > allocation.Quantity {
+		return 0, fmt.Errorf("cannot return %d units of line %d: only %d of %d remain", quantity, lineNumber, allocation.Quantity-allocation.ReturnedQuantity, allocation.Quantity)
+	}
+
+	clawback := allocation.ClawbackFor(allocation.ReturnedQuantity, quantity)
+	if toCents(clawback) > toCents(usage.Remaining()) {
+		clawback = usage.Remaining()
+	}
+	_, err = tx.Exec("UPDATE CouponUsageAllocations SET returned_quantity = returned_quantity + ? WHERE usage_id = ? AND line_number = ?",
+		quantity, usageID, lineNumber)
+	if err != nil {
+		return 0, err
+	}
+	if toCents(clawback) > 0 {
+		reason := fmt.Sprintf("returned %d units of line %d", quantity, lineNumber)
+		if _, err := usage.reverse(tx, clawback, reason); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return clawback, nil
+}
+
+// Retrieve the SKU IDs a coupon is restricted to
+func GetCouponSKUIDs(db *sql.DB, couponID int) ([]int, error) {
+	rows, err := db.Query("SELECT sku_id FROM SKU_Coupon_Mapping WHERE coupon_id = ?", couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var skuIDs []int
+	for rows.Next() {
+		var skuID int
+		if err := rows.Scan(&skuID); err != nil {
+			return nil, err
+		}
+		skuIDs = append(skuIDs, skuID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return skuIDs, nil
+}
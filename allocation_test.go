@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocateDiscountSplitsPennies(t *testing.T) {
+	lines := []OrderLine{
+		{SKUID: 1, Quantity: 1, UnitPrice: 5},
+		{SKUID: 2, Quantity: 1, UnitPrice: 5},
+		{SKUID: 3, Quantity: 1, UnitPrice: 5},
+	}
+	for run := 0; run < 3; run++ {
+		allocations, err := AllocateDiscount(10, lines, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []float64
+		for _, allocation := range allocations {
+			got = append(got, allocation.DiscountAmount)
+		}
+		// The leftover penny goes to the first of the tied lines
+		if want := []float64{3.34, 3.33, 3.33}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAllocateDiscountSkipsZeroPricedLines(t *testing.T) {
+	lines := []OrderLine{
+		{SKUID: 1, Quantity: 1, UnitPrice: 0},
+		{SKUID: 2, Quantity: 2, UnitPrice: 10},
+		{SKUID: 3, Quantity: 0, UnitPrice: 10},
+	}
+	allocations, err := AllocateDiscount(5, lines, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LineAllocation{{LineNumber: 2, SKUID: 2, Quantity: 2, LineAmount: 20, DiscountAmount: 5}}
+	if !reflect.DeepEqual(allocations, want) {
+		t.Errorf("got %+v, want %+v", allocations, want)
+	}
+
+	allocations, err = AllocateDiscount(5, lines[:1], nil)
+	if err != nil || len(allocations) != 0 {
+		t.Errorf("got %+v, %v, want no allocations", allocations, err)
+	}
+}
+
+func TestSplitCents(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{"equal weights", 1000, []int64{500, 500, 500}, []int64{334, 333, 333}},
+		{"largest remainder first", 100, []int64{1, 2, 3}, []int64{17, 33, 50}},
+		{"zero weight", 100, []int64{0, 100}, []int64{0, 100}},
+		{"no weight", 100, []int64{0, 0}, []int64{0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitCents(test.total, test.weights); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClawbackForSumsToAllocation(t *testing.T) {
+	allocation := LineAllocation{Quantity: 3, DiscountAmount: 10}
+	returns := []int{1, 1, 1}
+	var returned int
+	var cents int64
+	for _, quantity := range returns {
+		cents += toCents(allocation.ClawbackFor(returned, quantity))
+		returned += quantity
+	}
+	if cents != toCents(allocation.DiscountAmount) {
+		t.Errorf("clawbacks sum to %d cents, want %d", cents, toCents(allocation.DiscountAmount))
+	}
+
+	if got := allocation.ClawbackFor(2, 5); got != 3.34 {
+		t.Errorf("returning more units than remain claws back %.2f, want 3.34", got)
+	}
+	if got := allocation.ClawbackFor(0, -1); got != 0 {
+		t.Errorf("returning no units claws back %.2f, want 0", got)
+	}
+}
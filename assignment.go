@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Lists a user can be placed on for a coupon
+const (
+	AssignmentAllow = "allow"
+	AssignmentDeny  = "deny"
+)
+
+// assignmentBatchSize caps how many users are written per INSERT during bulk uploads
+const assignmentBatchSize = 500
+
+var ErrCouponNotAssigned = errors.New("coupon is not available to this user")
+
+// AssignmentError is returned when redeeming a coupon for a user on its denylist, or
+// for a user missing from its allowlist
+type AssignmentError struct {
+	CouponID int
+	UserID   int
+	Reason   ReasonCode
+}
+
+func (e *AssignmentError) Error() string {
+	return fmt.Sprintf("coupon %d is not available to user %d: %s", e.CouponID, e.UserID, e.Reason)
+}
+
+func (e *AssignmentError) Unwrap() error {
+	return ErrCouponNotAssigned
+}
+
+// Define a struct to represent how a coupon is assigned with respect to one user
+type CouponAssignment struct {
+	HasAllowList bool   // the coupon only works for the users on its allowlist
+	ListType     string // the list the user is on, empty when on neither
+}
+
+// Check returns the reason the user may not use the coupon, or ReasonNone
+func (a CouponAssignment) Check() ReasonCode {
+	if a.ListType == AssignmentDeny {
+		return ReasonUserDenied
+	}
+	if a.HasAllowList && a.ListType != AssignmentAllow {
+		return ReasonNotAssigned
+	}
+	return ReasonNone
+}
+
+// Retrieve how a coupon is assigned with respect to a user
+func GetCouponAssignment(db queryer, couponID, userID int) (CouponAssignment, error) {
+	var assignment CouponAssignment
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM Coupon_Assignments WHERE coupon_id = ? AND list_type = ?)",
+		couponID, AssignmentAllow).Scan(&assignment.HasAllowList)
+	if err != nil {
+		return assignment, err
+	}
+
+	err = db.QueryRow("SELECT list_type FROM Coupon_Assignments WHERE coupon_id = ? AND user_id = ?", couponID, userID).
+		Scan(&assignment.ListType)
+	if err == sql.ErrNoRows {
+		return assignment, nil
+	}
+	return assignment, err
+}
+
+// Reject a redemption by a user the coupon's allowlist or denylist excludes
+func checkAssignment(tx *sql.Tx, req RedemptionRequest) error {
+	assignment, err := GetCouponAssignment(tx, req.CouponID, req.UserID)
+	if err != nil {
+		return err
+	}
+	if reason := assignment.Check(); reason != ReasonNone {
+		return &AssignmentError{CouponID: req.CouponID, UserID: req.UserID, Reason: reason}
+	}
+	return nil
+}
+
+// Assign a coupon to a single user, making it unusable by anyone else
+func AssignCouponToUser(db *sql.DB, couponID, userID int) error {
+	_, err := AssignCouponToUsers(db, couponID, AssignmentAllow, []int{userID})
+	return err
+}
+
+// AssignCouponToUsers places users on the allowlist or denylist of a coupon, moving
+// users already on the other list, and returns how many users were written
+func AssignCouponToUsers(db *sql.DB, couponID int, listType string, userIDs []int) (int, error) {
+	if listType != AssignmentAllow && listType != AssignmentDeny {
+		return 0, fmt.Errorf("invalid assignment list %q", listType)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	written := 0
+	for start := 0; start < len(userIDs); start += assignmentBatchSize {
+		end := start + assignmentBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		batch := userIDs[start:end]
+
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*3)
+		for i, userID := range batch {
+			placeholders[i] = "(?, ?, ?)"
+			args = append(args, couponID, userID, listType)
+		}
+		_, err := tx.Exec("INSERT INTO Coupon_Assignments (coupon_id, user_id, list_type) VALUES "+strings.Join(placeholders, ", ")+
+			" ON DUPLICATE KEY UPDATE list_type = VALUES(list_type)", args...)
+		if err != nil {
+			return 0, err
+		}
+		written += len(batch)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// Remove users from whichever list of a coupon they are on
+func UnassignCouponFromUsers(db *sql.DB, couponID int, userIDs []int) error {
+	for _, userID := range userIDs {
+		if _, err := db.Exec("DELETE FROM Coupon_Assignments WHERE coupon_id = ? AND user_id = ?", couponID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseUserIDList reads an uploaded list of user IDs, one per line or comma separated.
+// Blank lines are skipped, as is a first line made up only of non-numeric column
+// names; any other field that is not a user ID is reported with its line number.
+func ParseUserIDList(r io.Reader) ([]int, error) {
+	var userIDs []int
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		var fields []string
+		for _, field := range strings.Split(scanner.Text(), ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+		if lineNumber == 1 && isHeader(fields) {
+			continue
+		}
+		for _, field := range fields {
+			userID, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid user ID %q", lineNumber, field)
+			}
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// Report whether every field of a line is a column name rather than a number
+func isHeader(fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	for _, field := range fields {
+		if _, err := strconv.Atoi(field); err == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUserIDList(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []int
+		wantErr string
+	}{
+		{"one per line", "1\n2\n3\n", []int{1, 2, 3}, ""},
+		{"comma separated", "1, 2,3\n\n4\n", []int{1, 2, 3, 4}, ""},
+		{"header", "user_id\n1\n2\n", []int{1, 2}, ""},
+		{"multi-column header", "user_id, email\n1\n", []int{1}, ""},
+		{"numeric first line with junk", "1,abc\n2\n", nil, "line 1"},
+		{"invalid later line", "user_id\n1\nabc\n", nil, "line 3"},
+		{"empty", "", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseUserIDList(strings.NewReader(test.input))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Define a struct to represent which past redemptions a backtest replays
+type BacktestFilter struct {
+	From       time.Time
+	To         time.Time
+	CampaignID int // 0 for every campaign
+	CouponID   int // 0 for every coupon
+}
+
+// Define a struct to represent a past redemption on which a candidate ruleset decides
+// differently from what actually happened
+type BacktestCase struct {
+	UsageID      int
+	CouponCode   string
+	UserID       int
+	OrderID      int
+	UsageDate    string
+	ActualStatus string
+	Accepted     bool
+	Result       ValidationResult
+	ActualCost   float64
+	Cost         float64
+}
+
+// Define a struct to represent the outcome of replaying past redemptions through a
+// candidate ruleset version. Costs are the discounts granted, net of reversals.
+type BacktestReport struct {
+	Ruleset           string
+	Version           string
+	Replayed          int
+	ActualAccepted    int
+	ActualRejected    int
+	CandidateAccepted int
+	CandidateRejected int
+	NewlyAccepted     int
+	NewlyRejected     int
+	Errors            int
+	WithoutOrder      int // replayed without order lines, none having been recorded
+	RejectReasons     map[ReasonCode]int
+	ActualCost        float64
+	CandidateCost     float64
+	CostDifference    float64
+	Disagreements     []BacktestCase
+}
+
+// Define a struct to represent a past redemption being replayed
+type historicalUsage struct {
+	CouponUsage
+	Coupon Coupon
+	Order  OrderContext
+	At     time.Time
+}
+
+// Define a struct to represent a usage in the history of a customer
+type customerHistoryEntry struct {
+	CouponID int
+	Code     string
+	Date     string
+	At       time.Time
+	IsUsed   bool
+	Status   string
+}
+
+// BacktestRulesetVersion replays past redemptions through a saved ruleset version
+func BacktestRulesetVersion(db *sql.DB, name, version string, filter BacktestFilter) (BacktestReport, error) {
+	candidate, err := GetRulesetVersion(db, name, version)
+	if err != nil {
+		return BacktestReport{}, err
+	}
+	return BacktestRuleset(db, candidate, filter)
+}
+
+// BacktestRuleset replays the redemptions recorded between filter.From and filter.To,
+// and the attempts fraud scoring blocked, through a candidate ruleset and compares its
+// decisions with what actually happened. Each coupon is evaluated with its attached
+// rulesets, the candidate standing in for the active version of its name, or added
+// as a coupon ruleset when the coupon does not have it attached. The customer context
+// is reconstructed from the redemptions that came before: previous redemptions, the
+// uses of the coupon within its per-user window, and whether the customer is new.
+// The order context is rebuilt from the line allocations and sales context recorded
+// with the usage, the recorded country standing in for the shipping country; payment
+// methods are not recorded, and usages recorded without allocations are replayed with
+// an empty order and counted in WithoutOrder. Baseline checks such as dates and limits
+// are not replayed. Dates are read in the time zone of each coupon's campaign, as
+// they are at validation.
+//
+// Costs are estimated from the discounts actually granted, or requested for blocked
+// attempts, scaled by how the rules change the coupon's discount value.
+func BacktestRuleset(db *sql.DB, candidate RuleSet, filter BacktestFilter) (BacktestReport, error) {
+	report := BacktestReport{Ruleset: candidate.Name, Version: candidate.Version, RejectReasons: make(map[ReasonCode]int)}
+
+	ruleEngine := NewRuleEngine()
+	if err := ruleEngine.Compile(candidate); err != nil {
+		return report, err
+	}
+
+	usages, err := getHistoricalUsages(db, filter)
+	if err != nil {
+		return report, err
+	}
+	histories, err := getCustomerHistories(db, filter)
+	if err != nil {
+		return report, err
+	}
+
+	attachedByCoupon := make(map[int][]AttachedRuleset)
+	locationByCampaign := make(map[int]*time.Location)
+	for _, usage := range usages {
+		attached, ok := attachedByCoupon[usage.CouponID]
+		if !ok {
+			attached, err = GetRulesetsForCoupon(db, usage.CouponID, usage.Coupon.CampaignID)
+			if err != nil {
+				return report, err
+			}
+			attached = withCandidate(attached, candidate)
+			attachedByCoupon[usage.CouponID] = attached
+		}
+
+		location, ok := locationByCampaign[usage.Coupon.CampaignID]
+		if !ok {
+			campaign, err := GetCampaignByID(db, usage.Coupon.CampaignID)
+			if err != nil {
+				return report, err
+			}
+			location, err = campaign.Location()
+			if err != nil {
+				return report, err
+			}
+			locationByCampaign[usage.Coupon.CampaignID] = location
+		}
+
+		customerContext := reconstructCustomerContext(usage, histories[usage.UserID])
+
+		coupon := usage.Coupon
+		coupon.IsValid = true
+		order := usage.Order
+		evaluation, err := ruleEngine.EvaluateFacts(attached, RuleFacts{
+			Coupon:          &coupon,
+			CustomerContext: &customerContext,
+			ChangeContext:   &ChangeContext{},
+			OptionsContext:  &OptionsContext{},
+			OrderContext:    &order,
+			Location:        location,
+			At:              usage.At,
+		})
+		if err != nil {
+			return report, err
+		}
+		report.add(usage, evaluation)
+	}
+
+	report.CandidateCost = fromCents(toCents(report.CandidateCost))
+	report.ActualCost = fromCents(toCents(report.ActualCost))
+	report.CostDifference = fromCents(toCents(report.CandidateCost) - toCents(report.ActualCost))
+	return report, nil
+}
+
+// Count one replayed redemption in the report
+func (r *BacktestReport) add(usage historicalUsage, evaluation CouponEvaluation) {
+	r.Replayed++
+	if evaluation.Err != nil {
+		r.Errors++
+	}
+	if len(usage.Order.Lines) == 0 {
+		r.WithoutOrder++
+	}
+
+	actuallyAccepted := usage.Status != UsageStatusBlocked
+	actualCost := 0.0
+	estimate := usage.RequestedAmount
+	if actuallyAccepted {
+		r.ActualAccepted++
+		actualCost = fromCents(toCents(usage.DiscountAmount) - toCents(usage.ReversedAmount))
+		estimate = actualCost
+	} else {
+		r.ActualRejected++
+	}
+
+	cost := 0.0
+	if evaluation.Valid {
+		r.CandidateAccepted++
+		cost = estimate
+		if usage.Coupon.DiscountValue > 0 && evaluation.Coupon.DiscountValue != usage.Coupon.DiscountValue {
+			cost = estimate * evaluation.Coupon.DiscountValue / usage.Coupon.DiscountValue
+		}
+	} else {
+		r.CandidateRejected++
+		r.RejectReasons[evaluation.Reason]++
+	}
+	r.ActualCost += actualCost
+	r.CandidateCost += cost
+
+	if evaluation.Valid == actuallyAccepted {
+		return
+	}
+	if evaluation.Valid {
+		r.NewlyAccepted++
+	} else {
+		r.NewlyRejected++
+	}
+	r.Disagreements = append(r.Disagreements, BacktestCase{
+		UsageID:      usage.ID,
+		CouponCode:   usage.Coupon.Code,
+		UserID:       usage.UserID,
+		OrderID:      usage.OrderID,
+		UsageDate:    usage.UsageDate,
+		ActualStatus: usage.Status,
+		Accepted:     evaluation.Valid,
+		Result:       evaluation.ValidationResult,
+		ActualCost:   actualCost,
+		Cost:         fromCents(toCents(cost)),
+	})
+}
+
+// Put the candidate in place of the attached ruleset with the same name, or attach it
+// to the coupon when there is none
+func withCandidate(attached []AttachedRuleset, candidate RuleSet) []AttachedRuleset {
+	replaced := make([]AttachedRuleset, 0, len(attached)+1)
+	found := false
+	for _, a := range attached {
+		if a.Name == candidate.Name {
+			a.RuleSet = candidate
+			found = true
+		}
+		replaced = append(replaced, a)
+	}
+	if !found {
+		replaced = append(replaced, AttachedRuleset{RuleSet: candidate, Scope: RulesetScopeCoupon, Mode: RulesetModeAll})
+	}
+	return replaced
+}
+
+// Build the FROM and WHERE clauses selecting, as u, the usages a backtest replays
+func historicalUsageClauses(filter BacktestFilter) (string, []interface{}) {
+	clauses := "FROM CouponUsage u JOIN Coupons c ON c.id = u.coupon_id WHERE u.usage_date >= ? AND u.usage_date < ? AND u.status IN (?, ?, ?)"
+	args := []interface{}{filter.From, filter.To, UsageStatusRedeemed, UsageStatusReversed, UsageStatusBlocked}
+	if filter.CampaignID != 0 {
+		clauses += " AND c.campaign_id = ?"
+		args = append(args, filter.CampaignID)
+	}
+	if filter.CouponID != 0 {
+		clauses += " AND u.coupon_id = ?"
+		args = append(args, filter.CouponID)
+	}
+	return clauses, args
+}
+
+// Retrieve the redemptions and blocked attempts a backtest replays, oldest first
+func getHistoricalUsages(db *sql.DB, filter BacktestFilter) ([]historicalUsage, error) {
+	clauses, args := historicalUsageClauses(filter)
+	rows, err := db.Query("SELECT u.id, u.coupon_id, u.user_id, u.order_id, u.usage_date, u.status, u.requested_amount, u.discount_amount, u.reversed_amount, u.channel, u.store_id, u.country, u.region "+
+		clauses+" ORDER BY u.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usages []historicalUsage
+	for rows.Next() {
+		var usage historicalUsage
+		if err := rows.Scan(&usage.ID, &usage.CouponID, &usage.UserID, &usage.OrderID, &usage.UsageDate, &usage.Status, &usage.RequestedAmount, &usage.DiscountAmount, &usage.ReversedAmount,
+			&usage.Channel, &usage.StoreID, &usage.Country, &usage.Region); err != nil {
+			return nil, err
+		}
+		if usage.At, err = parseUsageDate(usage.UsageDate); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	lines, err := getHistoricalOrderLines(db, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	coupons := make(map[int]Coupon)
+	for i := range usages {
+		usages[i].Order = historicalOrder(usages[i].CouponUsage, lines[usages[i].ID])
+		coupon, ok := coupons[usages[i].CouponID]
+		if !ok {
+			coupon, err = GetCouponByID(db, usages[i].CouponID)
+			if err != nil {
+				return nil, err
+			}
+			coupons[coupon.ID] = coupon
+		}
+		usages[i].Coupon = coupon
+	}
+	return usages, nil
+}
+
+// Define a struct to represent an order line as recorded in a usage's allocations
+type historicalOrderLine struct {
+	OrderLine
+	LineAmount float64
+}
+
+// Retrieve in one query the order lines recorded with the usages a backtest replays,
+// keyed by usage and in line order
+func getHistoricalOrderLines(db *sql.DB, filter BacktestFilter) (map[int][]historicalOrderLine, error) {
+	clauses, args := historicalUsageClauses(filter)
+	rows, err := db.Query("SELECT a.usage_id, a.sku_id, COALESCE(s.product_category, ''), a.quantity, a.line_amount FROM CouponUsageAllocations a LEFT JOIN SKU s ON s.id = a.sku_id "+
+		"WHERE a.usage_id IN (SELECT u.id "+clauses+") ORDER BY a.usage_id, a.line_number", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := make(map[int][]historicalOrderLine)
+	for rows.Next() {
+		var usageID int
+		var line historicalOrderLine
+		if err := rows.Scan(&usageID, &line.SKUID, &line.Category, &line.Quantity, &line.LineAmount); err != nil {
+			return nil, err
+		}
+		if line.Quantity > 0 {
+			line.UnitPrice = fromCents(toCents(line.LineAmount) / int64(line.Quantity))
+		}
+		lines[usageID] = append(lines[usageID], line)
+	}
+	return lines, rows.Err()
+}
+
+// Rebuild the order facts of a past usage from its recorded lines and sales context.
+// Totals are the recorded line amounts; unit prices are derived from them.
+func historicalOrder(usage CouponUsage, recorded []historicalOrderLine) OrderContext {
+	lines := make([]OrderLine, len(recorded))
+	var cents int64
+	for i, line := range recorded {
+		lines[i] = line.OrderLine
+		cents += toCents(line.LineAmount)
+	}
+	order := NewOrderContext(lines, fromCents(cents))
+	order.Subtotal = order.Total
+	order.OrderID = usage.OrderID
+	order.Channel = usage.Channel
+	order.StoreID = usage.StoreID
+	order.ShippingCountry = usage.Country
+	return order
+}
+
+// Retrieve in one query the usages, from before filter.To, of every customer with a
+// usage the backtest replays, keyed by user and oldest first
+func getCustomerHistories(db *sql.DB, filter BacktestFilter) (map[int][]customerHistoryEntry, error) {
+	clauses, args := historicalUsageClauses(filter)
+	rows, err := db.Query("SELECT h.user_id, h.coupon_id, hc.code, h.usage_date, h.is_used, h.status FROM CouponUsage h JOIN Coupons hc ON hc.id = h.coupon_id "+
+		"WHERE h.usage_date < ? AND h.user_id IN (SELECT u.user_id "+clauses+") ORDER BY h.user_id, h.usage_date, h.id",
+		append([]interface{}{filter.To}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	histories := make(map[int][]customerHistoryEntry)
+	for rows.Next() {
+		var userID int
+		var entry customerHistoryEntry
+		if err := rows.Scan(&userID, &entry.CouponID, &entry.Code, &entry.Date, &entry.IsUsed, &entry.Status); err != nil {
+			return nil, err
+		}
+		if entry.At, err = parseUsageDate(entry.Date); err != nil {
+			return nil, err
+		}
+		histories[userID] = append(histories[userID], entry)
+	}
+	return histories, rows.Err()
+}
+
+// Parse a usage date as scanned from a DATETIME column
+func parseUsageDate(value string) (time.Time, error) {
+	for _, layout := range redemptionDateLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid usage date %q", value)
+}
+
+// Rebuild the customer context of a past redemption from the customer's usages before it
+func reconstructCustomerContext(usage historicalUsage, history []customerHistoryEntry) CustomerContext {
+	customerContext := CustomerContext{UserID: usage.UserID}
+	var windowStart time.Time
+	if usage.Coupon.PerUserWindowDays > 0 {
+		windowStart = usage.At.AddDate(0, 0, -usage.Coupon.PerUserWindowDays)
+	}
+
+	for _, entry := range history {
+		if !entry.At.Before(usage.At) {
+			break
+		}
+		if entry.Status == UsageStatusRedeemed || entry.Status == UsageStatusReversed {
+			customerContext.PreviousRedemptions = append(customerContext.PreviousRedemptions, RedemptionHistoryEntry{CouponCode: entry.Code, RedemptionDate: entry.Date})
+		}
+		if entry.CouponID == usage.CouponID && entry.IsUsed && !entry.At.Before(windowStart) {
+			customerContext.CouponUsageCount++
+		}
+	}
+	customerContext.IsNewCustomer = len(customerContext.PreviousRedemptions) == 0
+	return customerContext
+}
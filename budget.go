@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Budget policies decide what happens to a discount the campaign budget cannot fully cover
+const (
+	BudgetPolicyReject = "reject"
+	BudgetPolicyCap    = "cap"
+)
+
+var ErrBudgetExceeded = errors.New("campaign budget exceeded")
+
+// BudgetExceededError is returned when a redemption would overspend its campaign's budget
+type BudgetExceededError struct {
+	CampaignID int
+	Budget     float64
+	Spent      float64
+	Requested  float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("campaign %d has spent %.2f of its %.2f budget and cannot grant %.2f", e.CampaignID, e.Spent, e.Budget, e.Requested)
+}
+
+func (e *BudgetExceededError) Unwrap() error {
+	return ErrBudgetExceeded
+}
+
+// spentQuery sums the discount still held by redemptions and open reservations
+const spentQuery = "SELECT COALESCE(SUM(u.discount_amount - u.reversed_amount), 0) FROM CouponUsage u JOIN Coupons c ON c.id = u.coupon_id WHERE c.campaign_id = ? AND " + activeUsageCondition
+
+// Retrieve the total discount a campaign has given away, including open reservations
+func GetCampaignBudgetSpent(db queryer, campaignID int) (float64, error) {
+	var spent float64
+	err := db.QueryRow(spentQuery, campaignID).Scan(&spent)
+	return spent, err
+}
+
+// grantWithinBudget works out the discount the campaign can afford for a redemption.
+// Campaigns without a budget grant the whole discount. Otherwise the campaign row is
+// locked so concurrent redemptions across all its coupons see each other's spend, and
+// a discount exceeding what is left is either rejected or capped to the remainder,
+// depending on the campaign's budget policy.
+func grantWithinBudget(tx *sql.Tx, campaignID int, req RedemptionRequest) (usageGrant, error) {
+	grant := fullGrant(req)
+
+	var budget float64
+	if err := tx.QueryRow("SELECT budget FROM Campaigns WHERE id = ?", campaignID).Scan(&budget); err != nil {
+		return grant, err
+	}
+	if budget <= 0 {
+		return grant, nil
+	}
+
+	var policy string
+	err := tx.QueryRow("SELECT budget, budget_policy FROM Campaigns WHERE id = ? FOR UPDATE", campaignID).Scan(&budget, &policy)
+	if err != nil {
+		return grant, err
+	}
+	spent, err := GetCampaignBudgetSpent(tx, campaignID)
+	if err != nil {
+		return grant, err
+	}
+
+	remainingCents := toCents(budget) - toCents(spent)
+	requestedCents := toCents(grant.DiscountAmount)
+	if requestedCents <= remainingCents {
+		return grant, nil
+	}
+	if policy != BudgetPolicyCap || remainingCents <= 0 {
+		return grant, &BudgetExceededError{CampaignID: campaignID, Budget: budget, Spent: spent, Requested: grant.DiscountAmount}
+	}
+
+	grant.DiscountAmount = fromCents(remainingCents)
+	if len(grant.Allocations) > 0 {
+		grant.Allocations = reallocate(grant.Allocations, grant.DiscountAmount)
+	}
+	return grant, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/hyperjumptech/grule-rule-engine/engine"
+)
+
+// Define a struct to represent a fact field changed by rules
+type FieldChange struct {
+	Field  string // fact and field name, e.g. Coupon.DiscountValue
+	Before interface{}
+	After  interface{}
+}
+
+// Define a struct to represent the outcome of one ruleset on one coupon
+type RulesetResult struct {
+	Ruleset string
+	Version string
+	Scope   string // campaign or coupon, empty for rulesets passed in directly
+	Mode    string
+	ValidationResult
+	Changes []FieldChange
+	Err     error
+}
+
+// Define a struct to represent the outcome of all rulesets on one coupon. Coupon holds
+// the coupon as the rules left it; Err is the error that stopped evaluation, if any.
+type CouponEvaluation struct {
+	ValidationResult
+	Coupon   Coupon
+	Rulesets []RulesetResult
+	Err      error
+}
+
+// Define a struct to represent the facts rules can read and change. OrderContext is
+// the order being bought and must be set; an empty OrderContext stands for no order.
+// Location and At are read by the rule helpers: the campaign's time zone (UTC when
+// nil) and the moment of the order (now when zero).
+type RuleFacts struct {
+	Coupon          *Coupon
+	CustomerContext *CustomerContext
+	ChangeContext   *ChangeContext
+	OptionsContext  *OptionsContext
+	OrderContext    *OrderContext
+	Location        *time.Location
+	At              time.Time
+}
+
+// Add the facts to a new data context under the names rules refer to them by
+func (f RuleFacts) dataContext() (ast.IDataContext, error) {
+	ctx := ast.NewDataContext()
+	facts := []struct {
+		name  string
+		value interface{}
+	}{
+		{"Coupon", f.Coupon},
+		{"CustomerContext", f.CustomerContext},
+		{"ChangeContext", f.ChangeContext},
+		{"OptionsContext", f.OptionsContext},
+		{"OrderContext", f.OrderContext},
+		{"Helpers", newRuleHelpers(f)},
+	}
+	for _, fact := range facts {
+		if err := ctx.Add(fact.name, fact.value); err != nil {
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
+
+// Copy the fact values so changes made by rules can be listed, or undone, afterwards
+func (f RuleFacts) snapshot() [5]interface{} {
+	return [5]interface{}{*f.Coupon, *f.CustomerContext, *f.ChangeContext, *f.OptionsContext, *f.OrderContext}
+}
+
+// Put the fact values back as they were in a snapshot
+func (f RuleFacts) restore(snapshot [5]interface{}) {
+	*f.Coupon = snapshot[0].(Coupon)
+	*f.CustomerContext = snapshot[1].(CustomerContext)
+	*f.ChangeContext = snapshot[2].(ChangeContext)
+	*f.OptionsContext = snapshot[3].(OptionsContext)
+	*f.OrderContext = snapshot[4].(OrderContext)
+}
+
+// List the fields that differ between two snapshots of the facts
+func (f RuleFacts) changes(before, after [5]interface{}) []FieldChange {
+	names := [5]string{"Coupon", "CustomerContext", "ChangeContext", "OptionsContext", "OrderContext"}
+	var changes []FieldChange
+	for i := range before {
+		changes = append(changes, changedFields(names[i], before[i], after[i])...)
+	}
+	return changes
+}
+
+// List the exported fields of two values of the same struct type that differ
+func changedFields(prefix string, before, after interface{}) []FieldChange {
+	beforeValue := reflect.ValueOf(before)
+	afterValue := reflect.ValueOf(after)
+	structType := beforeValue.Type()
+
+	var changes []FieldChange
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		old := beforeValue.Field(i).Interface()
+		current := afterValue.Field(i).Interface()
+		if !reflect.DeepEqual(old, current) {
+			changes = append(changes, FieldChange{Field: prefix + "." + field.Name, Before: old, After: current})
+		}
+	}
+	return changes
+}
+
+// Define a struct to represent rulesets evaluated as one step: a single ruleset that
+// must pass, or a group of rulesets of which one passing is enough
+type rulesetStage struct {
+	Rulesets []*compiledRuleset
+	Scope    string
+	Mode     string
+}
+
+// Define a struct to represent the state of one coupon evaluation
+type evaluator struct {
+	facts      RuleFacts
+	ctx        ast.IDataContext
+	tracker    *validityTracker
+	evaluation CouponEvaluation
+}
+
+// Run stages of rulesets in order against a single coupon. The rulesets of an any
+// stage each start from the facts as the stage found them; the first one leaving the
+// coupon valid ends the stage, and when none does the last one's outcome stands.
+// Evaluation stops at the first ruleset that fails to run, which rejects the coupon
+// with RULE_ERROR.
+func evaluateStages(stages []rulesetStage, facts RuleFacts) CouponEvaluation {
+	coupon := facts.Coupon
+	ev := evaluator{facts: facts, tracker: newValidityTracker(coupon)}
+
+	ctx, err := facts.dataContext()
+	if err != nil {
+		return ev.fail(err, "")
+	}
+	ev.ctx = ctx
+
+	// Execute the rulesets with the context, remembering which rule decided the outcome
+	for _, stage := range stages {
+		start := facts.snapshot()
+		decided := ev.tracker.responsible
+		for i, ruleset := range stage.Rulesets {
+			if i > 0 {
+				facts.restore(start)
+				ev.tracker.restart(decided)
+			}
+			if err := ev.run(ruleset, stage); err != nil {
+				return ev.fail(err, ruleset.Name)
+			}
+			if stage.Mode == RulesetModeAny && coupon.IsValid {
+				break
+			}
+		}
+	}
+
+	ev.evaluation.ValidationResult = ruleOutcome(*coupon, ev.tracker.responsible)
+	ev.evaluation.Coupon = *coupon
+	return ev.evaluation
+}
+
+// Run one ruleset of a stage and record its result
+func (ev *evaluator) run(ruleset *compiledRuleset, stage rulesetStage) error {
+	coupon := ev.facts.Coupon
+	result := RulesetResult{Ruleset: ruleset.Name, Version: ruleset.Version, Scope: stage.Scope, Mode: stage.Mode}
+	before := ev.facts.snapshot()
+	decided := ev.tracker.responsible
+	ev.tracker.running, ev.tracker.responsible = "", ""
+
+	err := runRuleset(ruleset, ev.ctx, ev.tracker)
+	result.Changes = ev.facts.changes(before, ev.facts.snapshot())
+	if err != nil {
+		result.Err = fmt.Errorf("applying ruleset %s v%s to coupon %s: %w", ruleset.Name, ruleset.Version, coupon.Code, err)
+		result.ValidationResult = invalidResult(*coupon, ReasonRuleError, "", ruleset.Name)
+		ev.evaluation.Rulesets = append(ev.evaluation.Rulesets, result)
+		return result.Err
+	}
+
+	result.ValidationResult = ruleOutcome(*coupon, ev.tracker.responsible)
+	ev.evaluation.Rulesets = append(ev.evaluation.Rulesets, result)
+	if ev.tracker.responsible == "" {
+		ev.tracker.responsible = decided
+	}
+	return nil
+}
+
+// Reject the coupon with RULE_ERROR because of an error evaluating it
+func (ev *evaluator) fail(err error, ruleset string) CouponEvaluation {
+	ev.evaluation.Err = err
+	ev.evaluation.ValidationResult = invalidResult(*ev.facts.Coupon, ReasonRuleError, "", ruleset)
+	ev.evaluation.Coupon = *ev.facts.Coupon
+	return ev.evaluation
+}
+
+// Execute one compiled ruleset against the data context
+func runRuleset(ruleset *compiledRuleset, ctx ast.IDataContext, tracker *validityTracker) error {
+	knowledgeBase, err := ruleset.acquire()
+	if err != nil {
+		return err
+	}
+	defer ruleset.release(knowledgeBase)
+
+	gruleEngine := engine.NewGruleEngine()
+	gruleEngine.Listeners = append(gruleEngine.Listeners, tracker)
+	err = gruleEngine.Execute(ctx, knowledgeBase)
+	tracker.settle()
+	return err
+}
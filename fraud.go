@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Decisions of the fraud-scoring stage of a redemption
+const (
+	FraudAllow  = "allow"
+	FraudReview = "review"
+	FraudBlock  = "block"
+)
+
+// UsageStatusBlocked marks a redemption attempt refused by fraud scoring
+const UsageStatusBlocked = "blocked"
+
+var ErrFraudBlocked = errors.New("redemption blocked by fraud checks")
+
+// FraudBlockedError is returned when fraud scoring blocks a redemption
+type FraudBlockedError struct {
+	UsageID int
+	Score   int
+	Reasons []string
+}
+
+func (e *FraudBlockedError) Error() string {
+	return fmt.Sprintf("redemption %d blocked with fraud score %d: %s", e.UsageID, e.Score, strings.Join(e.Reasons, ", "))
+}
+
+func (e *FraudBlockedError) Unwrap() error {
+	return ErrFraudBlocked
+}
+
+// Define a struct to represent the thresholds and weights of fraud scoring
+type FraudConfig struct {
+	VelocityPerHour       int     // redemptions of one coupon per hour considered suspicious
+	MaxAccountsPerDevice  int     // accounts redeeming from one device fingerprint
+	MaxAccountsPerPayment int     // accounts redeeming with one payment fingerprint
+	FingerprintWindowDays int     // how far back fingerprints are compared
+	SpikeFactor           float64 // last hour versus the hourly average of the past week
+	SpikeMinimum          int     // redemptions in the last hour before a spike counts
+	VelocityWeight        int
+	DeviceWeight          int
+	PaymentWeight         int
+	SpikeWeight           int
+	ReviewScore           int
+	BlockScore            int
+}
+
+// DefaultFraudConfig is the fraud scoring applied to redemptions
+var DefaultFraudConfig = FraudConfig{
+	VelocityPerHour:       100,
+	MaxAccountsPerDevice:  3,
+	MaxAccountsPerPayment: 3,
+	FingerprintWindowDays: 30,
+	SpikeFactor:           10,
+	SpikeMinimum:          20,
+	VelocityWeight:        30,
+	DeviceWeight:          40,
+	PaymentWeight:         40,
+	SpikeWeight:           30,
+	ReviewScore:           40,
+	BlockScore:            70,
+}
+
+// Define a struct to represent the behaviour fraud scoring looks at
+type FraudSignals struct {
+	CouponRedemptionsLastHour int
+	CouponHourlyAverage       float64
+	AccountsOnDevice          int
+	AccountsOnPayment         int
+}
+
+// Define a struct to represent the outcome of fraud scoring
+type FraudAssessment struct {
+	Score    int
+	Decision string
+	Reasons  []string
+}
+
+// ScoreFraud turns fraud signals into a score between 0 and 100 and a decision
+func ScoreFraud(signals FraudSignals, config FraudConfig) FraudAssessment {
+	var assessment FraudAssessment
+
+	if config.VelocityPerHour > 0 && signals.CouponRedemptionsLastHour >= config.VelocityPerHour {
+		assessment.Score += config.VelocityWeight
+		assessment.Reasons = append(assessment.Reasons, "coupon_velocity")
+	}
+	if config.MaxAccountsPerDevice > 0 && signals.AccountsOnDevice > config.MaxAccountsPerDevice {
+		assessment.Score += config.DeviceWeight
+		assessment.Reasons = append(assessment.Reasons, "shared_device")
+	}
+	if config.MaxAccountsPerPayment > 0 && signals.AccountsOnPayment > config.MaxAccountsPerPayment {
+		assessment.Score += config.PaymentWeight
+		assessment.Reasons = append(assessment.Reasons, "shared_payment")
+	}
+	if signals.CouponRedemptionsLastHour >= config.SpikeMinimum &&
+		float64(signals.CouponRedemptionsLastHour) > config.SpikeFactor*signals.CouponHourlyAverage {
+		assessment.Score += config.SpikeWeight
+		assessment.Reasons = append(assessment.Reasons, "redemption_spike")
+	}
+	if assessment.Score > 100 {
+		assessment.Score = 100
+	}
+
+	switch {
+	case assessment.Score >= config.BlockScore:
+		assessment.Decision = FraudBlock
+	case assessment.Score >= config.ReviewScore:
+		assessment.Decision = FraudReview
+	default:
+		assessment.Decision = FraudAllow
+	}
+	return assessment
+}
+
+// Gather the fraud signals of a redemption from past CouponUsage rows
+func gatherFraudSignals(tx *sql.Tx, req RedemptionRequest, config FraudConfig) (FraudSignals, error) {
+	var signals FraudSignals
+
+	err := tx.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND status <> ? AND usage_date >= DATE_SUB(NOW(), INTERVAL 1 HOUR)",
+		req.CouponID, UsageStatusBlocked).Scan(&signals.CouponRedemptionsLastHour)
+	if err != nil {
+		return signals, err
+	}
+
+	var lastWeek int
+	err = tx.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND status <> ? AND usage_date >= DATE_SUB(NOW(), INTERVAL 7 DAY) AND usage_date < DATE_SUB(NOW(), INTERVAL 1 HOUR)",
+		req.CouponID, UsageStatusBlocked).Scan(&lastWeek)
+	if err != nil {
+		return signals, err
+	}
+	signals.CouponHourlyAverage = float64(lastWeek) / (7*24 - 1)
+
+	if req.DeviceFingerprint != "" {
+		signals.AccountsOnDevice, err = countAccountsOnFingerprint(tx, "device_fingerprint", req.DeviceFingerprint, req.UserID, config.FingerprintWindowDays)
+		if err != nil {
+			return signals, err
+		}
+	}
+	if req.PaymentFingerprint != "" {
+		signals.AccountsOnPayment, err = countAccountsOnFingerprint(tx, "payment_fingerprint", req.PaymentFingerprint, req.UserID, config.FingerprintWindowDays)
+		if err != nil {
+			return signals, err
+		}
+	}
+	return signals, nil
+}
+
+// Count the accounts, including userID, that redeemed coupons with a fingerprint recently
+func countAccountsOnFingerprint(tx *sql.Tx, column, fingerprint string, userID, windowDays int) (int, error) {
+	var others int
+	err := tx.QueryRow("SELECT COUNT(DISTINCT user_id) FROM CouponUsage WHERE "+column+" = ? AND user_id <> ? AND usage_date >= DATE_SUB(NOW(), INTERVAL ? DAY)",
+		fingerprint, userID, windowDays).Scan(&others)
+	return others + 1, err
+}
+
+// Retrieve redemptions held for manual fraud review, newest first
+func GetUsagesForReview(db *sql.DB) ([]CouponUsage, error) {
+	rows, err := db.Query("SELECT id, coupon_id, user_id, order_id, usage_date, status, discount_amount, fraud_score, fraud_decision, fraud_reasons FROM CouponUsage WHERE fraud_decision = ? ORDER BY id DESC", FraudReview)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usages []CouponUsage
+	for rows.Next() {
+		var usage CouponUsage
+		var reasons string
+		if err := rows.Scan(&usage.ID, &usage.CouponID, &usage.UserID, &usage.OrderID, &usage.UsageDate, &usage.Status, &usage.DiscountAmount, &usage.Fraud.Score, &usage.Fraud.Decision, &reasons); err != nil {
+			return nil, err
+		}
+		if reasons != "" {
+			usage.Fraud.Reasons = strings.Split(reasons, ",")
+		}
+		usages = append(usages, usage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
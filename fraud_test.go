@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScoreFraud(t *testing.T) {
+	tests := []struct {
+		name     string
+		signals  FraudSignals
+		score    int
+		decision string
+		reasons  []string
+	}{
+		{"quiet", FraudSignals{CouponRedemptionsLastHour: 5, CouponHourlyAverage: 4, AccountsOnDevice: 1, AccountsOnPayment: 1}, 0, FraudAllow, nil},
+		{"accounts at the limit", FraudSignals{AccountsOnDevice: 3, AccountsOnPayment: 3}, 0, FraudAllow, nil},
+		{"spike below review", FraudSignals{CouponRedemptionsLastHour: 25, CouponHourlyAverage: 2}, 30, FraudAllow, []string{"redemption_spike"}},
+		{"spike under the minimum", FraudSignals{CouponRedemptionsLastHour: 19}, 0, FraudAllow, nil},
+		{"shared device reviews", FraudSignals{AccountsOnDevice: 4}, 40, FraudReview, []string{"shared_device"}},
+		{"velocity and spike review", FraudSignals{CouponRedemptionsLastHour: 100, CouponHourlyAverage: 5}, 60, FraudReview, []string{"coupon_velocity", "redemption_spike"}},
+		{"shared device and payment block", FraudSignals{AccountsOnDevice: 4, AccountsOnPayment: 4}, 80, FraudBlock, []string{"shared_device", "shared_payment"}},
+		{"score capped at 100", FraudSignals{CouponRedemptionsLastHour: 150, CouponHourlyAverage: 1, AccountsOnDevice: 9, AccountsOnPayment: 9}, 100, FraudBlock,
+			[]string{"coupon_velocity", "shared_device", "shared_payment", "redemption_spike"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ScoreFraud(test.signals, DefaultFraudConfig)
+			if got.Score != test.score || got.Decision != test.decision {
+				t.Errorf("got score %d and %q, want %d and %q", got.Score, got.Decision, test.score, test.decision)
+			}
+			if !reflect.DeepEqual(got.Reasons, test.reasons) {
+				t.Errorf("got reasons %v, want %v", got.Reasons, test.reasons)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/go-sql-driver/mysql v1.7.1
 	github.com/hyperjumptech/grule-rule-engine v1.14.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
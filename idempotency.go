@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrIdempotencyConflict = errors.New("redemption replay does not match the original request")
+	ErrReplayNotActive     = errors.New("redemption replay matches a usage that is no longer active")
+)
+
+// IdempotencyConflictError is returned when a replayed redemption differs from the
+// request that recorded the original usage
+type IdempotencyConflictError struct {
+	UsageID int
+	Field   string
+}
+
+func (e *IdempotencyConflictError) Error() string {
+	return fmt.Sprintf("redemption replay conflicts with usage %d: %s differs", e.UsageID, e.Field)
+}
+
+func (e *IdempotencyConflictError) Unwrap() error {
+	return ErrIdempotencyConflict
+}
+
+// ReplayNotActiveError is returned when an IdempotencyKey matches a usage that was
+// released, expired or reversed, so the request can neither replay nor record it again
+type ReplayNotActiveError struct {
+	UsageID int
+	Status  string
+}
+
+func (e *ReplayNotActiveError) Error() string {
+	return fmt.Sprintf("redemption replay matches usage %d, which is %s", e.UsageID, e.Status)
+}
+
+func (e *ReplayNotActiveError) Unwrap() error {
+	return ErrReplayNotActive
+}
+
+// findReplay looks for the usage an earlier attempt of the request recorded. Only live
+// usages replay: redemptions, blocked attempts and reservations that have not expired.
+// Requests carrying an IdempotencyKey are matched on it, and a match that is no longer
+// live is reported as a *ReplayNotActiveError; other requests are matched on the coupon
+// and order of a live usage. Requests with neither a key nor an order never replay. A
+// match that disagrees with the request is reported as an *IdempotencyConflictError.
+func findReplay(tx *sql.Tx, req RedemptionRequest) (CouponUsage, bool, error) {
+	var usage CouponUsage
+	var expires, idempotencyKey sql.NullString
+	var fraudReasons string
+	var live bool
+	columns := "id, coupon_id, user_id, order_id, usage_date, is_used, status, expires_at, requested_amount, discount_amount, idempotency_key, fraud_score, fraud_decision, fraud_reasons, " +
+		"COALESCE(status IN ('redeemed', 'blocked') OR (status = 'reserved' AND expires_at > NOW()), false)"
+
+	var row *sql.Row
+	switch {
+	case req.IdempotencyKey != "":
+		row = tx.QueryRow("SELECT "+columns+" FROM CouponUsage WHERE idempotency_key = ?", req.IdempotencyKey)
+	case req.OrderID != 0:
+		row = tx.QueryRow("SELECT "+columns+" FROM CouponUsage WHERE coupon_id = ? AND order_id = ? AND "+
+			"(status IN (?, ?) OR (status = ? AND expires_at > NOW())) ORDER BY id LIMIT 1",
+			req.CouponID, req.OrderID, UsageStatusRedeemed, UsageStatusBlocked, UsageStatusReserved)
+	default:
+		return CouponUsage{}, false, nil
+	}
+	err := row.Scan(&usage.ID, &usage.CouponID, &usage.UserID, &usage.OrderID, &usage.UsageDate, &usage.IsUsed, &usage.Status, &expires, &usage.RequestedAmount, &usage.DiscountAmount, &idempotencyKey,
+		&usage.Fraud.Score, &usage.Fraud.Decision, &fraudReasons, &live)
+	if err == sql.ErrNoRows {
+		return CouponUsage{}, false, nil
+	}
+	if err != nil {
+		return CouponUsage{}, false, err
+	}
+	usage.ExpiresAt = expires.String
+	usage.IdempotencyKey = idempotencyKey.String
+	if fraudReasons != "" {
+		usage.Fraud.Reasons = strings.Split(fraudReasons, ",")
+	}
+
+	switch {
+	case usage.CouponID != req.CouponID:
+		return usage, false, &IdempotencyConflictError{UsageID: usage.ID, Field: "coupon"}
+	case usage.OrderID != req.OrderID:
+		return usage, false, &IdempotencyConflictError{UsageID: usage.ID, Field: "order"}
+	case usage.UserID != req.UserID:
+		return usage, false, &IdempotencyConflictError{UsageID: usage.ID, Field: "user"}
+	case toCents(usage.RequestedAmount) != toCents(req.discount()):
+		return usage, false, &IdempotencyConflictError{UsageID: usage.ID, Field: "discount amount"}
+	case !live && usage.Status == UsageStatusReserved:
+		return usage, false, &ReplayNotActiveError{UsageID: usage.ID, Status: UsageStatusExpired}
+	case !live:
+		return usage, false, &ReplayNotActiveError{UsageID: usage.ID, Status: usage.Status}
+	}
+	return usage, true, nil
+}
@@ -4,39 +4,46 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/hyperjumptech/grule-rule-engine/ast"
-	"github.com/hyperjumptech/grule-rule-engine/builder"
-	"github.com/hyperjumptech/grule-rule-engine/engine"
-	"github.com/hyperjumptech/grule-rule-engine/pkg"
 )
 
 // Define a struct to represent the Campaign data
 type Campaign struct {
-	ID        int
-	Name      string
-	StartDate string
-	EndDate   string
-	IsActive  bool
+	ID           int
+	Name         string
+	StartDate    string
+	EndDate      string
+	TimeZone     string // IANA zone the dates and windows are expressed in, e.g. America/New_York
+	Windows      []ValidityWindow
+	Restrictions Restrictions
+	IsActive     bool
+	Budget       float64 // total discount the campaign may give away, 0 for no budget
+	BudgetPolicy string  // what to do with a discount exceeding the budget: reject or cap
 }
 
 // Define a struct to represent the Coupon data
 type Coupon struct {
-	ID              int
-	Code            string
-	Description     string
-	DiscountType    string
-	DiscountValue   float64
-	MinimumPurchase float64
-	ExpirationDate  string
-	IsSingleUse     bool
-	UsageLimit      int
-	IsActive        bool
-	CampaignID      int
-	IsValid         bool
-	NotValidReason  string
+	ID                int
+	Code              string
+	Description       string
+	DiscountType      string
+	DiscountValue     float64
+	MinimumPurchase   float64
+	ExpirationDate    string
+	IsSingleUse       bool
+	UsageLimit        int
+	PerUserLimit      int
+	PerUserWindowDays int // rolling window for PerUserLimit, 0 for the coupon's lifetime
+	IsActive          bool
+	CampaignID        int
+	IsValid           bool
+	NotValidReason    string
+	ReasonCode        string
+	ReversalPolicy    string
+	Restrictions      Restrictions
 }
 
 func (mf *Coupon) IsNewCustomer(IsNewCustomer bool) string {
@@ -63,12 +70,23 @@ type SKUToCouponMapping struct {
 
 // Define a struct to represent coupon usage
 type CouponUsage struct {
-	ID        int
-	CouponID  int
-	UserID    int
-	OrderID   int
-	UsageDate string
-	IsUsed    bool
+	ID                 int
+	CouponID           int
+	UserID             int
+	OrderID            int
+	UsageDate          string
+	IsUsed             bool
+	Status             string
+	ExpiresAt          string
+	RequestedAmount    float64
+	DiscountAmount     float64
+	ReversedAmount     float64
+	Allocations        []LineAllocation
+	IdempotencyKey     string
+	DeviceFingerprint  string
+	PaymentFingerprint string
+	Fraud              FraudAssessment
+	SalesContext
 }
 
 // Define a struct to represent referral data
@@ -114,6 +132,7 @@ type CustomerContext struct {
 	PreviousRedemptions []RedemptionHistoryEntry
 	IsNewCustomer       bool
 	UserID              int
+	CouponUsageCount    int // uses of the coupon being validated within its per-user window
 	// Add other relevant customer data here
 }
 
@@ -179,10 +198,10 @@ func main() {
 	// Example: Map coupons to SKUs
 	MapCouponsToSKUs(db, generatedCoupons, []int{sku1ID, sku2ID})
 
-	// Example: Record coupon usage
+	// Example: Redeem a coupon on an order
 	user1ID := 1    // Replace with a valid user ID
 	order1ID := 101 // Replace with a valid order ID
-	RecordCouponUsage(db, generatedCoupons[0].ID, user1ID, order1ID)
+	Redeem(db, RedemptionRequest{CouponID: generatedCoupons[0].ID, UserID: user1ID, OrderID: order1ID})
 
 	// Example: Send coupon expiration notifications
 	SendCouponExpirationNotifications(db, generatedCoupons)
@@ -191,13 +210,13 @@ func main() {
 	ruleset := RuleSet{
 		Name: "SummerSaleRules",
 		Definition: `
-            rule "MinimumPurchaseRule"
+            rule MinimumPurchaseRule "The order must reach the minimum purchase" {
                 when
-                    $coupon : Coupon($minimumPurchase : minimum_purchase_amount)
-                    $order : Order(totalAmount >= $minimumPurchase)
+                    OrderContext.Total < Coupon.MinimumPurchase
                 then
-                    $coupon.setValid(true);
-            end
+                    Coupon.Reject("RULE_REJECTED", "The order does not reach the minimum purchase.");
+                    Retract("MinimumPurchaseRule");
+            }
         `,
 	}
 	ApplyRuleset(ruleset, generatedCoupons)
@@ -209,6 +228,11 @@ func main() {
 */
 
 func main() {
+	// Run ruleset fixtures: coupons test-rules testdata/rulesets/*.json testdata/rulesets/*.yaml
+	if len(os.Args) > 1 && os.Args[1] == "test-rules" {
+		os.Exit(runTestRulesCommand(os.Stdout, os.Args[2:]))
+	}
+
 	// Example: Define and apply a ruleset for coupon validation
 	ruleset := RuleSet{
 		Name:    "SummerSaleRules",
@@ -231,20 +255,38 @@ func main() {
 		customerContext := GenerateRandomCustomerContext()
 		changeContext := GenerateRandomChangeContext()
 		optionsContext := GenerateRandomOptionsContext()
-		ApplyRuleset(rulesets, generatedCoupons, customerContext, changeContext, optionsContext)
+		orderContext := GenerateRandomOrderContext()
+		results, err := ApplyRuleset(rulesets, generatedCoupons, customerContext, changeContext, optionsContext, orderContext)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, result := range results {
+			if result.Valid {
+				fmt.Printf("Coupon %s is valid\n", result.CouponCode)
+			} else {
+				fmt.Printf("Coupon %s is not valid: %s [%s] %s\n", result.CouponCode, result.Message, result.Reason, result.Rule)
+			}
+		}
 	}
 
 }
 
-// Insert a new campaign into the Campaigns table and return the campaign ID
+// Insert a new campaign into the Campaigns table, together with its validity windows
+// and restrictions, and return the campaign ID
 func InsertCampaign(db *sql.DB, campaign Campaign) (int, error) {
-	stmt, err := db.Prepare("INSERT INTO Campaigns (campaign_name, start_date, end_date, is_active) VALUES (?, ?, ?, ?)")
+	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
+
+	budgetPolicy := campaign.BudgetPolicy
+	if budgetPolicy == "" {
+		budgetPolicy = BudgetPolicyReject
+	}
 
-	result, err := stmt.Exec(campaign.Name, campaign.StartDate, campaign.EndDate, campaign.IsActive)
+	result, err := tx.Exec("INSERT INTO Campaigns (campaign_name, start_date, end_date, time_zone, is_active, budget, budget_policy) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		campaign.Name, campaign.StartDate, campaign.EndDate, campaign.TimeZone, campaign.IsActive, campaign.Budget, budgetPolicy)
 	if err != nil {
 		return 0, err
 	}
@@ -254,6 +296,19 @@ func InsertCampaign(db *sql.DB, campaign Campaign) (int, error) {
 		return 0, err
 	}
 
+	for _, window := range campaign.Windows {
+		if err := InsertCampaignWindow(tx, int(campaignID), window); err != nil {
+			return 0, err
+		}
+	}
+	if err := insertCampaignRestrictions(tx, int(campaignID), campaign.Restrictions); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
 	fmt.Println("Campaign inserted successfully")
 	return int(campaignID), nil
 }
@@ -328,33 +383,7 @@ func FindCouponsExpiringInDays(db *sql.DB, days int) ([]Coupon, error) {
 	today := time.Now()
 	endDate := today.AddDate(0, 0, days)
 
-	// Prepare the SQL query
-	query := `SELECT id, code, description, discount_type, discount_value, minimum_purchase, expiration_date, is_single_use, usage_limit, is_active, campaign_id FROM Coupons WHERE expiration_date BETWEEN ? AND ?`
-
-	// Execute the query
-	rows, err := db.Query(query, today.Format("2006-01-02"), endDate.Format("2006-01-02"))
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Iterate over the rows and populate the coupons
-	var coupons []Coupon
-	for rows.Next() {
-		var coupon Coupon
-		err := rows.Scan(&coupon.ID, &coupon.Code, &coupon.Description, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MinimumPurchase, &coupon.ExpirationDate, &coupon.IsSingleUse, &coupon.UsageLimit, &coupon.IsActive, &coupon.CampaignID)
-		if err != nil {
-			return nil, err
-		}
-		coupons = append(coupons, coupon)
-	}
-
-	// Check for errors encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return coupons, nil
+	return queryCoupons(db, "FROM Coupons WHERE expiration_date BETWEEN ? AND ?", today.Format("2006-01-02"), endDate.Format("2006-01-02"))
 }
 
 /*
@@ -374,33 +403,7 @@ func FindCouponsExpiringInDays(db *sql.DB, days int) ([]Coupon, error) {
 */
 
 func FindExpiredCoupons(db *sql.DB, start, end time.Time) ([]Coupon, error) {
-	// Prepare the SQL query
-	query := `SELECT id, code, description, discount_type, discount_value, minimum_purchase, expiration_date, is_single_use, usage_limit, is_active, campaign_id FROM Coupons WHERE expiration_date BETWEEN ? AND ?`
-
-	// Execute the query
-	rows, err := db.Query(query, start.Format("2006-01-02"), end.Format("2006-01-02"))
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Iterate over the rows and populate the coupons
-	var coupons []Coupon
-	for rows.Next() {
-		var coupon Coupon
-		err := rows.Scan(&coupon.ID, &coupon.Code, &coupon.Description, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MinimumPurchase, &coupon.ExpirationDate, &coupon.IsSingleUse, &coupon.UsageLimit, &coupon.IsActive, &coupon.CampaignID)
-		if err != nil {
-			return nil, err
-		}
-		coupons = append(coupons, coupon)
-	}
-
-	// Check for errors encountered during iteration
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return coupons, nil
+	return queryCoupons(db, "FROM Coupons WHERE expiration_date BETWEEN ? AND ?", start.Format("2006-01-02"), end.Format("2006-01-02"))
 }
 
 // Insert a new SKU into the SKU table and return the SKU ID
@@ -439,17 +442,6 @@ func InsertSKUToCouponMapping(db *sql.DB, couponID, skuID int) {
 	fmt.Println("SKU-Coupon mapping inserted successfully")
 }
 
-// Record coupon usage
-func RecordCouponUsage(db *sql.DB, couponID, userID, orderID int) {
-	_, err := db.Exec("INSERT INTO CouponUsage (coupon_id, user_id, order_id, usage_date, is_used) "+
-		"VALUES (?, ?, ?, NOW(), true)",
-		couponID, userID, orderID)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Printf("Coupon usage recorded successfully for Coupon ID: %d\n", couponID)
-}
-
 // Send coupon expiration notifications
 func SendCouponExpirationNotifications(db *sql.DB, coupons []Coupon) {
 	for _, coupon := range coupons {
@@ -508,58 +500,32 @@ applyRuleset(db, ruleset, coupons, customerContext, changeContext, optionsContex
 
 */
 
-// Apply a ruleset to coupons for validation
-func ApplyRuleset(rulesets []RuleSet, coupons []Coupon, customerContext CustomerContext, changeContext ChangeContext, optionsContext OptionsContext) {
-	// Create a new knowledge base for Grule
-	knowledgeLibrary := ast.NewKnowledgeLibrary()
-
-	ruleBuilder := builder.NewRuleBuilder(knowledgeLibrary)
-
-	for _, ruleset := range rulesets {
-		bs := pkg.NewBytesResource([]byte(ruleset.Definition))
-		err := ruleBuilder.BuildRuleFromResource(ruleset.Name, ruleset.Version, bs)
+// ApplyRuleset runs rulesets against every coupon and returns one evaluation per
+// coupon, in order. Rules change the coupons in place; each coupon gets its own copy
+// of the contexts, the order included, so changes rules make to them do not leak
+// between coupons. It fails only when a ruleset cannot be compiled.
+func ApplyRuleset(rulesets []RuleSet, coupons []Coupon, customerContext CustomerContext, changeContext ChangeContext, optionsContext OptionsContext, orderContext OrderContext) ([]CouponEvaluation, error) {
+	return DefaultRuleEngine.EvaluateCoupons(rulesets, coupons, customerContext, changeContext, optionsContext, orderContext)
+}
+
+// ApplyAttachedRulesets runs the active rulesets attached to each coupon and its
+// campaign against the coupon, changing the coupons in place, and returns one
+// evaluation per coupon. Each coupon gets its own copy of the contexts, the order
+// included.
+func ApplyAttachedRulesets(db *sql.DB, coupons []Coupon, customerContext CustomerContext, changeContext ChangeContext, optionsContext OptionsContext, orderContext OrderContext) ([]CouponEvaluation, error) {
+	evaluations := make([]CouponEvaluation, len(coupons))
+	for i := range coupons {
+		attached, err := GetRulesetsForCoupon(db, coupons[i].ID, coupons[i].CampaignID)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-
-		// Load the ruleset definition into the knowledge base
-
-	}
-
-	for i, coupon := range coupons {
-
-		// Create a knowledge context for each coupon
-		ctx := ast.NewDataContext()
-		ctx.Add("Coupon", &coupon)
-		ctx.Add("CustomerContext", &customerContext)
-		ctx.Add("ChangeContext", &changeContext)
-		ctx.Add("OptionsContext", &optionsContext)
-
-		// Execute the ruleset with the context
-
-		for _, ruleset := range rulesets {
-			knowledgeBase, err := knowledgeLibrary.NewKnowledgeBaseInstance(ruleset.Name, ruleset.Version)
-			if err != nil {
-				log.Fatal(err)
-			}
-			engine := engine.NewGruleEngine()
-			fmt.Printf("Applying ruleset: %s v%s\n", knowledgeBase.Name, knowledgeBase.Version)
-			err = engine.Execute(ctx, knowledgeBase)
-			if err != nil {
-				log.Printf("Error applying ruleset to coupon %d: %s", i+1, err)
-			}
-			fmt.Printf("Ruleset %s Version %s applied to coupons\n", knowledgeBase.Name, knowledgeBase.Version)
-			// Check if the coupon is valid after ruleset execution
-			fmt.Printf("%+v\n", customerContext)
-			if coupon.IsValid {
-				fmt.Printf("Coupon %s is valid\n", coupon.Code)
-			} else {
-				fmt.Printf("Coupon %s is not valid: %s \n", coupon.Code, coupon.NotValidReason, coupon)
-			}
+		customer, change, options, order := customerContext, changeContext, optionsContext, orderContext
+		evaluations[i], err = DefaultRuleEngine.EvaluateAttached(attached, &coupons[i], &customer, &change, &options, &order)
+		if err != nil {
+			return nil, err
 		}
-
 	}
-
+	return evaluations, nil
 }
 
 // Implement referral system
@@ -596,24 +562,9 @@ func RecordReferral(db *sql.DB, referrerID, refereeID int) {
 
 // Retrieve coupons associated with a campaign by Campaign ID
 func GetCouponsByCampaignID(db *sql.DB, campaignID int) []Coupon {
-	rows, err := db.Query("SELECT * FROM Coupons WHERE campaign_id = ?", campaignID)
+	coupons, err := queryCoupons(db, "FROM Coupons WHERE campaign_id = ?", campaignID)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer rows.Close()
-
-	var coupons []Coupon
-	for rows.Next() {
-		var coupon Coupon
-		if err := rows.Scan(&coupon.ID, &coupon.Code, &coupon.Description, &coupon.DiscountType,
-			&coupon.DiscountValue, &coupon.MinimumPurchase, &coupon.ExpirationDate,
-			&coupon.IsSingleUse, &coupon.UsageLimit, &coupon.IsActive, &coupon.CampaignID); err != nil {
-			log.Fatal(err)
-		}
-		coupons = append(coupons, coupon)
-	}
-	if err := rows.Err(); err != nil {
-		log.Fatal(err)
-	}
 	return coupons
 }
@@ -0,0 +1,84 @@
+package main
+
+import "strings"
+
+// Define a struct to represent the order a coupon is validated for. It is added to
+// every rule evaluation as the OrderContext fact.
+type OrderContext struct {
+	OrderID         int
+	Subtotal        float64 // undiscounted amount of the lines
+	Total           float64 // amount the minimum purchase is checked against
+	ItemCount       int     // units over all lines
+	Lines           []OrderLine
+	SKUIDs          []int
+	Categories      []string
+	Channel         string
+	StoreID         int
+	ShippingCountry string // ISO 3166-1 alpha-2
+	PaymentMethod   string // e.g. card, paypal, gift_card
+}
+
+// NewOrderContext builds the order facts from the order lines, deriving the subtotal,
+// item count, SKUs and categories. A zero total defaults to the subtotal.
+func NewOrderContext(lines []OrderLine, total float64) OrderContext {
+	order := OrderContext{Lines: lines, Total: total}
+	order.derive()
+	return order
+}
+
+// Fill in the facts that follow from the lines
+func (o *OrderContext) derive() {
+	var cents int64
+	o.ItemCount, o.SKUIDs, o.Categories = 0, nil, nil
+	for _, line := range o.Lines {
+		cents += toCents(line.Total())
+		o.ItemCount += line.Quantity
+		if !containsInt(o.SKUIDs, line.SKUID) {
+			o.SKUIDs = append(o.SKUIDs, line.SKUID)
+		}
+		if line.Category != "" && !containsFold(o.Categories, line.Category) {
+			o.Categories = append(o.Categories, line.Category)
+		}
+	}
+	o.Subtotal = fromCents(cents)
+	if o.Total == 0 {
+		o.Total = o.Subtotal
+	}
+}
+
+// HasSKU reports whether the order holds the SKU
+func (o *OrderContext) HasSKU(skuID int64) bool {
+	for _, line := range o.Lines {
+		if int64(line.SKUID) == skuID && line.Quantity > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCategory reports whether the order holds a line in the category
+func (o *OrderContext) HasCategory(category string) bool {
+	return containsFold(o.Categories, category)
+}
+
+// CategoryTotal returns the undiscounted amount of the lines in a category
+func (o *OrderContext) CategoryTotal(category string) float64 {
+	var cents int64
+	for _, line := range o.Lines {
+		if strings.EqualFold(line.Category, category) {
+			cents += toCents(line.Total())
+		}
+	}
+	return fromCents(cents)
+}
+
+// CategoryQuantity returns the units ordered in a category
+func (o *OrderContext) CategoryQuantity(category string) int64 {
+	var quantity int64
+	for _, line := range o.Lines {
+		if strings.EqualFold(line.Category, category) {
+			quantity += int64(line.Quantity)
+		}
+	}
+	return quantity
+}
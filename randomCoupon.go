@@ -130,6 +130,21 @@ func GenerateRandomOptionsContext() OptionsContext {
 	}
 }
 
+func GenerateRandomOrderContext() OrderContext {
+	numLines := rand.Intn(4) + 1 // Random number of order lines (1 to 4)
+	var lines []OrderLine
+	for i := 0; i < numLines; i++ {
+		line := OrderLine{
+			SKUID:     rand.Intn(100) + 1,                                 // Random SKU ID
+			Category:  []string{"shoes", "apparel", "toys"}[rand.Intn(3)], // Random category
+			Quantity:  rand.Intn(3) + 1,                                   // Random quantity (1 to 3)
+			UnitPrice: float64(rand.Intn(10000)+100) / 100,                // Random price (1.00 to 100.99)
+		}
+		lines = append(lines, line)
+	}
+	return NewOrderContext(lines, 0)
+}
+
 func GenerateRandomCustomerContext() CustomerContext {
 	return CustomerContext{
 		UserID:              rand.Intn(1000),                   // Random user ID
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dimensions validation attempts are limited on
+const (
+	LimitByUser    = "user"
+	LimitByIP      = "ip"
+	LimitBySession = "session"
+)
+
+// Define a struct to represent the threshold of one rate limit dimension: more than
+// MaxAttempts within Window locks the key out for LockoutDuration
+type RateLimitRule struct {
+	MaxAttempts     int
+	Window          time.Duration
+	LockoutDuration time.Duration
+}
+
+// DefaultRateLimitRules are used by NewAttemptLimiter when no rules are given
+var DefaultRateLimitRules = map[string]RateLimitRule{
+	LimitByUser:    {MaxAttempts: 10, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+	LimitByIP:      {MaxAttempts: 30, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+	LimitBySession: {MaxAttempts: 10, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+}
+
+// RateLimitStore keeps attempt history and lockouts. The in-memory store suits a
+// single instance; a shared store lets several instances enforce the same limits.
+type RateLimitStore interface {
+	// Hit records an attempt for key and returns how many attempts fall within window
+	Hit(key string, now time.Time, window time.Duration) (int, error)
+	// LockedUntil returns when the lockout of key ends, zero when it is not locked
+	LockedUntil(key string, now time.Time) (time.Time, error)
+	// Lock locks key out until the given time
+	Lock(key string, until time.Time) error
+}
+
+// Define a struct to represent who is attempting to validate a coupon code
+type ValidationAttempt struct {
+	UserID    int
+	IP        string
+	SessionID string
+}
+
+// Define a struct to represent the decision on a validation attempt
+type RateLimitDecision struct {
+	Allowed     bool
+	Dimension   string
+	LockedUntil time.Time
+}
+
+// Define a struct to represent rate limiter counters
+type RateLimitStats struct {
+	Allowed  int64
+	Blocked  map[string]int64
+	Lockouts int64
+}
+
+// AttemptLimiter limits coupon validation attempts per user, IP and session with
+// sliding windows and lockouts, so codes cannot be enumerated by guessing
+type AttemptLimiter struct {
+	store RateLimitStore
+	rules map[string]RateLimitRule
+	now   func() time.Time
+
+	allowed  int64
+	lockouts int64
+	mu       sync.Mutex
+	blocked  map[string]int64
+}
+
+// Create an attempt limiter; nil rules use DefaultRateLimitRules
+func NewAttemptLimiter(store RateLimitStore, rules map[string]RateLimitRule) *AttemptLimiter {
+	if rules == nil {
+		rules = DefaultRateLimitRules
+	}
+	return &AttemptLimiter{
+		store:   store,
+		rules:   rules,
+		now:     time.Now,
+		blocked: make(map[string]int64),
+	}
+}
+
+// Allow records a validation attempt and decides whether it may proceed. An attempt is
+// blocked while any of its user, IP or session is locked out, in which case it is not
+// counted against any of them; otherwise it is counted against each, and exceeding a
+// limit locks that dimension out.
+func (l *AttemptLimiter) Allow(attempt ValidationAttempt) (RateLimitDecision, error) {
+	now := l.now()
+	keys := map[string]string{}
+	if attempt.UserID != 0 {
+		keys[LimitByUser] = fmt.Sprintf("%s:%d", LimitByUser, attempt.UserID)
+	}
+	if attempt.IP != "" {
+		keys[LimitByIP] = LimitByIP + ":" + attempt.IP
+	}
+	if attempt.SessionID != "" {
+		keys[LimitBySession] = LimitBySession + ":" + attempt.SessionID
+	}
+
+	var dimensions []string
+	for _, dimension := range []string{LimitByUser, LimitByIP, LimitBySession} {
+		if _, ok := keys[dimension]; !ok {
+			continue
+		}
+		if _, limited := l.rules[dimension]; limited {
+			dimensions = append(dimensions, dimension)
+		}
+	}
+
+	for _, dimension := range dimensions {
+		lockedUntil, err := l.store.LockedUntil(keys[dimension], now)
+		if err != nil {
+			return RateLimitDecision{}, err
+		}
+		if lockedUntil.After(now) {
+			return l.block(dimension, lockedUntil), nil
+		}
+	}
+
+	var exceeded []string
+	for _, dimension := range dimensions {
+		rule := l.rules[dimension]
+		attempts, err := l.store.Hit(keys[dimension], now, rule.Window)
+		if err != nil {
+			return RateLimitDecision{}, err
+		}
+		if attempts > rule.MaxAttempts {
+			exceeded = append(exceeded, dimension)
+		}
+	}
+
+	if len(exceeded) > 0 {
+		var first time.Time
+		for i, dimension := range exceeded {
+			lockedUntil := now.Add(l.rules[dimension].LockoutDuration)
+			if err := l.store.Lock(keys[dimension], lockedUntil); err != nil {
+				return RateLimitDecision{}, err
+			}
+			atomic.AddInt64(&l.lockouts, 1)
+			if i == 0 {
+				first = lockedUntil
+			}
+		}
+		return l.block(exceeded[0], first), nil
+	}
+
+	atomic.AddInt64(&l.allowed, 1)
+	return RateLimitDecision{Allowed: true}, nil
+}
+
+// Count and build a blocked decision
+func (l *AttemptLimiter) block(dimension string, lockedUntil time.Time) RateLimitDecision {
+	l.mu.Lock()
+	l.blocked[dimension]++
+	l.mu.Unlock()
+	return RateLimitDecision{Allowed: false, Dimension: dimension, LockedUntil: lockedUntil}
+}
+
+// Stats returns a snapshot of the limiter counters
+func (l *AttemptLimiter) Stats() RateLimitStats {
+	stats := RateLimitStats{
+		Allowed:  atomic.LoadInt64(&l.allowed),
+		Lockouts: atomic.LoadInt64(&l.lockouts),
+		Blocked:  make(map[string]int64),
+	}
+	l.mu.Lock()
+	for dimension, blocked := range l.blocked {
+		stats.Blocked[dimension] = blocked
+	}
+	l.mu.Unlock()
+	return stats
+}
+
+// memoryPruneInterval is how often the in-memory store drops keys with no attempt left
+// in their window and lockouts that ended
+const memoryPruneInterval = time.Minute
+
+// MemoryRateLimitStore keeps attempts and lockouts in process memory
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	attempts  map[string]*memoryAttempts
+	locks     map[string]time.Time
+	lastPrune time.Time
+}
+
+// Define a struct to represent the recent attempts of one key
+type memoryAttempts struct {
+	times  []time.Time
+	window time.Duration
+}
+
+// Create an empty in-memory rate limit store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		attempts: make(map[string]*memoryAttempts),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryRateLimitStore) Hit(key string, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastPrune) >= memoryPruneInterval {
+		s.prune(now)
+	}
+
+	// Drop attempts that slid out of the window before adding this one
+	entry, ok := s.attempts[key]
+	if !ok {
+		entry = &memoryAttempts{}
+		s.attempts[key] = entry
+	}
+	entry.window = window
+	cutoff := now.Add(-window)
+	kept := entry.times[:0]
+	for _, attempt := range entry.times {
+		if attempt.After(cutoff) {
+			kept = append(kept, attempt)
+		}
+	}
+	entry.times = append(kept, now)
+	return len(entry.times), nil
+}
+
+// Forget keys whose attempts all slid out of their window, and lockouts that ended, so
+// memory stays bounded by the keys seen recently
+func (s *MemoryRateLimitStore) prune(now time.Time) {
+	for key, entry := range s.attempts {
+		if len(entry.times) == 0 || !entry.times[len(entry.times)-1].After(now.Add(-entry.window)) {
+			delete(s.attempts, key)
+		}
+	}
+	for key, until := range s.locks {
+		if !until.After(now) {
+			delete(s.locks, key)
+		}
+	}
+	s.lastPrune = now
+}
+
+func (s *MemoryRateLimitStore) LockedUntil(key string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.locks[key]
+	if ok && !until.After(now) {
+		delete(s.locks, key)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (s *MemoryRateLimitStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.locks[key] = until
+	delete(s.attempts, key)
+	return nil
+}
+
+// SQLRateLimitStore shares attempts and lockouts between instances through the database
+type SQLRateLimitStore struct {
+	db *sql.DB
+}
+
+// Create a rate limit store backed by the RateLimitAttempts and RateLimitLockouts tables
+func NewSQLRateLimitStore(db *sql.DB) *SQLRateLimitStore {
+	return &SQLRateLimitStore{db: db}
+}
+
+// Hit records the attempt before counting, and commits it straight away, so concurrent
+// attempts on the same key each count every attempt recorded before theirs instead of
+// a stale total. Attempts that slid out of the window are deleted afterwards.
+func (s *SQLRateLimitStore) Hit(key string, now time.Time, window time.Duration) (int, error) {
+	if _, err := s.db.Exec("INSERT INTO RateLimitAttempts (limit_key, attempted_at) VALUES (?, ?)", key, now.UTC()); err != nil {
+		return 0, err
+	}
+	cutoff := now.Add(-window).UTC()
+	var attempts int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM RateLimitAttempts WHERE limit_key = ? AND attempted_at > ?", key, cutoff).Scan(&attempts)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.db.Exec("DELETE FROM RateLimitAttempts WHERE limit_key = ? AND attempted_at <= ?", key, cutoff); err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
+
+// LockedUntil lets the database work out how long the lockout has left, so the result
+// does not depend on how the DSN has DATETIME values scanned
+func (s *SQLRateLimitStore) LockedUntil(key string, now time.Time) (time.Time, error) {
+	var remaining int64
+	err := s.db.QueryRow("SELECT TIMESTAMPDIFF(MICROSECOND, ?, locked_until) FROM RateLimitLockouts WHERE limit_key = ? AND locked_until > ?",
+		now.UTC(), key, now.UTC()).Scan(&remaining)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(time.Duration(remaining) * time.Microsecond), nil
+}
+
+func (s *SQLRateLimitStore) Lock(key string, until time.Time) error {
+	_, err := s.db.Exec("INSERT INTO RateLimitLockouts (limit_key, locked_until) VALUES (?, ?) ON DUPLICATE KEY UPDATE locked_until = VALUES(locked_until)",
+		key, until.UTC())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("DELETE FROM RateLimitAttempts WHERE limit_key = ?", key)
+	return err
+}
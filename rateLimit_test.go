@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	rules := map[string]RateLimitRule{
+		LimitByUser:    {MaxAttempts: 2, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+		LimitByIP:      {MaxAttempts: 3, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+		LimitBySession: {MaxAttempts: 2, Window: 10 * time.Minute, LockoutDuration: 30 * time.Minute},
+	}
+	type step struct {
+		after     time.Duration // since the first attempt
+		attempt   ValidationAttempt
+		dimension string // the dimension that blocks the attempt, empty when allowed
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"window slides", []step{
+			{0, ValidationAttempt{UserID: 1}, ""},
+			{time.Minute, ValidationAttempt{UserID: 1}, ""},
+			{10*time.Minute + time.Second, ValidationAttempt{UserID: 1}, ""},
+			{10*time.Minute + 2*time.Second, ValidationAttempt{UserID: 1}, LimitByUser},
+		}},
+		{"lockout expires", []step{
+			{0, ValidationAttempt{UserID: 1}, ""},
+			{time.Second, ValidationAttempt{UserID: 1}, ""},
+			{2 * time.Second, ValidationAttempt{UserID: 1}, LimitByUser},
+			{20 * time.Minute, ValidationAttempt{UserID: 1}, LimitByUser},
+			{30*time.Minute + 2*time.Second, ValidationAttempt{UserID: 1}, ""},
+		}},
+		{"users, IPs and sessions counted apart", []step{
+			{0, ValidationAttempt{UserID: 1, IP: "10.0.0.1", SessionID: "a"}, ""},
+			{time.Second, ValidationAttempt{UserID: 1, IP: "10.0.0.2", SessionID: "b"}, ""},
+			{2 * time.Second, ValidationAttempt{UserID: 2, IP: "10.0.0.1", SessionID: "c"}, ""},
+			{3 * time.Second, ValidationAttempt{UserID: 3, IP: "10.0.0.1", SessionID: "a"}, ""},
+			{4 * time.Second, ValidationAttempt{UserID: 4, IP: "10.0.0.1", SessionID: "d"}, LimitByIP},
+			{5 * time.Second, ValidationAttempt{UserID: 5, IP: "10.0.0.3", SessionID: "a"}, LimitBySession},
+			{6 * time.Second, ValidationAttempt{UserID: 1, IP: "10.0.0.4"}, LimitByUser},
+		}},
+		{"locked attempts are not counted", []step{
+			{0, ValidationAttempt{SessionID: "a"}, ""},
+			{time.Second, ValidationAttempt{SessionID: "a"}, ""},
+			{2 * time.Second, ValidationAttempt{SessionID: "a"}, LimitBySession},
+			{3 * time.Second, ValidationAttempt{IP: "10.0.0.1", SessionID: "a"}, LimitBySession},
+			{4 * time.Second, ValidationAttempt{IP: "10.0.0.1", SessionID: "a"}, LimitBySession},
+			{5 * time.Second, ValidationAttempt{IP: "10.0.0.1", SessionID: "a"}, LimitBySession},
+			{6 * time.Second, ValidationAttempt{IP: "10.0.0.1", SessionID: "b"}, ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Date(2024, time.January, 5, 12, 0, 0, 0, time.UTC)
+			limiter := NewAttemptLimiter(NewMemoryRateLimitStore(), rules)
+			for i, step := range test.steps {
+				now := start.Add(step.after)
+				limiter.now = func() time.Time { return now }
+				decision, err := limiter.Allow(step.attempt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decision.Allowed != (step.dimension == "") || decision.Dimension != step.dimension {
+					t.Errorf("attempt %d: got allowed %v by %q, want blocked by %q", i+1, decision.Allowed, decision.Dimension, step.dimension)
+				}
+				if !decision.Allowed && !decision.LockedUntil.After(now) {
+					t.Errorf("attempt %d: blocked until %v, which is not after %v", i+1, decision.LockedUntil, now)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lifecycle states of a CouponUsage row
+const (
+	UsageStatusReserved = "reserved"
+	UsageStatusRedeemed = "redeemed"
+	UsageStatusReleased = "released"
+	UsageStatusExpired  = "expired"
+)
+
+// activeUsageCondition selects the CouponUsage rows that count against a coupon's
+// usage limit: completed redemptions and reservations that have not expired yet
+const activeUsageCondition = "(is_used = true OR (status = 'reserved' AND expires_at > NOW()))"
+
+var ErrUsageLimitReached = errors.New("coupon usage limit reached")
+
+// UsageLimitError is returned when redeeming a coupon that has no usage left, either
+// in total or, when UserID is set, for that customer
+type UsageLimitError struct {
+	CouponID int
+	UserID   int
+	Limit    int
+	Used     int
+}
+
+func (e *UsageLimitError) Error() string {
+	if e.UserID != 0 {
+		return fmt.Sprintf("coupon %d has been used %d of %d times by user %d", e.CouponID, e.Used, e.Limit, e.UserID)
+	}
+	return fmt.Sprintf("coupon %d has been used %d of %d times", e.CouponID, e.Used, e.Limit)
+}
+
+func (e *UsageLimitError) Unwrap() error {
+	return ErrUsageLimitReached
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Define a struct to represent a request to redeem a coupon on an order
+type RedemptionRequest struct {
+	CouponID           int
+	UserID             int
+	OrderID            int
+	DiscountAmount     float64
+	Allocations        []LineAllocation
+	IdempotencyKey     string
+	DeviceFingerprint  string
+	PaymentFingerprint string
+	SalesContext
+}
+
+// Total discount of the redemption, summed from the allocations when not given
+func (r RedemptionRequest) discount() float64 {
+	if r.DiscountAmount != 0 || len(r.Allocations) == 0 {
+		return r.DiscountAmount
+	}
+	var cents int64
+	for _, allocation := range r.Allocations {
+		cents += toCents(allocation.DiscountAmount)
+	}
+	return fromCents(cents)
+}
+
+// Define a struct to represent the discount a redemption is actually granted, and the
+// fraud assessment it was granted under
+type usageGrant struct {
+	DiscountAmount float64
+	Allocations    []LineAllocation
+	Fraud          FraudAssessment
+}
+
+// Grant the whole discount a redemption asks for
+func fullGrant(req RedemptionRequest) usageGrant {
+	return usageGrant{DiscountAmount: req.discount(), Allocations: req.Allocations, Fraud: FraudAssessment{Decision: FraudAllow}}
+}
+
+// Define a struct to represent the usage limits of a coupon
+type couponLimits struct {
+	CampaignID        int
+	Total             int
+	PerUser           int
+	PerUserWindowDays int
+}
+
+// usageLimit returns how many times the coupon may be used in total, 0 meaning unlimited
+func usageLimit(isSingleUse bool, limit int) int {
+	if isSingleUse && (limit <= 0 || limit > 1) {
+		return 1
+	}
+	return limit
+}
+
+// Redeem records the use of a coupon on an order. The coupon row is locked for the
+// duration of the transaction so concurrent redemptions of the same coupon are
+// serialized, and the redemption fails with a *UsageLimitError once the coupon's
+// usage limit or single-use flag is exhausted, with a *RestrictionError when the
+// coupon or its campaign does not allow the sales context, with an *AssignmentError
+// when the coupon's allowlist or denylist excludes the user, with a *BudgetExceededError
+// when its campaign cannot afford the discount, or with a *FraudBlockedError when fraud
+// scoring blocks it; blocked attempts are still recorded with status blocked. Redeem is
+// idempotent: replaying a request for the same order, or with the same IdempotencyKey,
+// returns the original usage instead of recording another one, and a replay matching
+// an open reservation commits it.
+func Redeem(db *sql.DB, req RedemptionRequest) (CouponUsage, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	defer tx.Rollback()
+
+	existing, replayed, grant, err := prepareUsage(tx, req)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	if replayed && existing.Status == UsageStatusReserved {
+		return commitReplayedReservation(tx, existing)
+	}
+	if replayed {
+		return existing, nil
+	}
+	if grant.Fraud.Decision == FraudBlock {
+		return recordBlockedUsage(tx, req, grant)
+	}
+
+	usage, err := insertCouponUsage(tx, req, grant, UsageStatusRedeemed, 0)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return CouponUsage{}, err
+	}
+	return usage, nil
+}
+
+// prepareUsage locks the coupon row for the rest of the transaction and either finds
+// the usage an earlier attempt of the same request recorded, or checks that the
+// coupon still has usage left and works out the discount its campaign can grant
+func prepareUsage(tx *sql.Tx, req RedemptionRequest) (CouponUsage, bool, usageGrant, error) {
+	limits, err := lockCoupon(tx, req.CouponID)
+	if err != nil {
+		return CouponUsage{}, false, usageGrant{}, err
+	}
+
+	existing, found, err := findReplay(tx, req)
+	if err == nil && found && existing.Status == UsageStatusBlocked {
+		err = &FraudBlockedError{UsageID: existing.ID, Score: existing.Fraud.Score, Reasons: existing.Fraud.Reasons}
+	}
+	if err != nil || found {
+		return existing, found, usageGrant{}, err
+	}
+
+	if err := checkRestrictions(tx, req, limits.CampaignID); err != nil {
+		return CouponUsage{}, false, usageGrant{}, err
+	}
+	if err := checkAssignment(tx, req); err != nil {
+		return CouponUsage{}, false, usageGrant{}, err
+	}
+	if err := checkCapacity(tx, req.CouponID, req.UserID, limits); err != nil {
+		return CouponUsage{}, false, usageGrant{}, err
+	}
+
+	signals, err := gatherFraudSignals(tx, req, DefaultFraudConfig)
+	if err != nil {
+		return CouponUsage{}, false, usageGrant{}, err
+	}
+	assessment := ScoreFraud(signals, DefaultFraudConfig)
+	if assessment.Decision == FraudBlock {
+		grant := fullGrant(req)
+		grant.Fraud = assessment
+		return CouponUsage{}, false, grant, nil
+	}
+
+	grant, err := grantWithinBudget(tx, limits.CampaignID, req)
+	grant.Fraud = assessment
+	return CouponUsage{}, false, grant, err
+}
+
+// Record a redemption attempt blocked by fraud scoring and report it as an error
+func recordBlockedUsage(tx *sql.Tx, req RedemptionRequest, grant usageGrant) (CouponUsage, error) {
+	grant.DiscountAmount = 0
+	grant.Allocations = nil
+	usage, err := insertCouponUsage(tx, req, grant, UsageStatusBlocked, 0)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return CouponUsage{}, err
+	}
+	return usage, &FraudBlockedError{UsageID: usage.ID, Score: grant.Fraud.Score, Reasons: grant.Fraud.Reasons}
+}
+
+// Lock the coupon row for the rest of the transaction and return its usage limits
+func lockCoupon(tx *sql.Tx, couponID int) (couponLimits, error) {
+	var isSingleUse bool
+	var limits couponLimits
+	err := tx.QueryRow("SELECT campaign_id, is_single_use, usage_limit, per_user_limit, per_user_window_days FROM Coupons WHERE id = ? FOR UPDATE", couponID).
+		Scan(&limits.CampaignID, &isSingleUse, &limits.Total, &limits.PerUser, &limits.PerUserWindowDays)
+	if err != nil {
+		return limits, err
+	}
+	limits.Total = usageLimit(isSingleUse, limits.Total)
+	return limits, nil
+}
+
+// Fail with a *UsageLimitError when the coupon has no usage left in total or for the user
+func checkCapacity(tx *sql.Tx, couponID, userID int, limits couponLimits) error {
+	if limits.Total > 0 {
+		used, err := CountCouponUsage(tx, couponID)
+		if err != nil {
+			return err
+		}
+		if used >= limits.Total {
+			return &UsageLimitError{CouponID: couponID, Limit: limits.Total, Used: used}
+		}
+	}
+
+	if limits.PerUser > 0 {
+		used, err := CountUserCouponUsage(tx, couponID, userID, limits.PerUserWindowDays)
+		if err != nil {
+			return err
+		}
+		if used >= limits.PerUser {
+			return &UsageLimitError{CouponID: couponID, UserID: userID, Limit: limits.PerUser, Used: used}
+		}
+	}
+	return nil
+}
+
+// Insert a CouponUsage row in the given state and its line allocations. Reservations
+// expire after ttl; other states ignore it.
+func insertCouponUsage(tx *sql.Tx, req RedemptionRequest, grant usageGrant, status string, ttl time.Duration) (CouponUsage, error) {
+	usage := CouponUsage{
+		CouponID:           req.CouponID,
+		UserID:             req.UserID,
+		OrderID:            req.OrderID,
+		IsUsed:             status == UsageStatusRedeemed,
+		Status:             status,
+		RequestedAmount:    req.discount(),
+		DiscountAmount:     grant.DiscountAmount,
+		Allocations:        grant.Allocations,
+		IdempotencyKey:     req.IdempotencyKey,
+		DeviceFingerprint:  req.DeviceFingerprint,
+		PaymentFingerprint: req.PaymentFingerprint,
+		Fraud:              grant.Fraud,
+		SalesContext:       req.SalesContext,
+	}
+
+	// Expiry is computed by the database so it compares consistently with NOW()
+	var ttlSeconds interface{}
+	if status == UsageStatusReserved {
+		ttlSeconds = int64(ttl / time.Second)
+	}
+
+	var idempotencyKey interface{}
+	if req.IdempotencyKey != "" {
+		idempotencyKey = req.IdempotencyKey
+	}
+
+	result, err := tx.Exec("INSERT INTO CouponUsage (coupon_id, user_id, order_id, usage_date, is_used, status, expires_at, requested_amount, discount_amount, idempotency_key, channel, store_id, country, region, "+
+		"device_fingerprint, payment_fingerprint, fraud_score, fraud_decision, fraud_reasons) "+
+		"VALUES (?, ?, ?, NOW(), ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		usage.CouponID, usage.UserID, usage.OrderID, usage.IsUsed, usage.Status, ttlSeconds, usage.RequestedAmount, usage.DiscountAmount, idempotencyKey,
+		usage.Channel, usage.StoreID, usage.Country, usage.Region,
+		usage.DeviceFingerprint, usage.PaymentFingerprint, usage.Fraud.Score, usage.Fraud.Decision, strings.Join(usage.Fraud.Reasons, ","))
+	if err != nil {
+		return usage, err
+	}
+	usageID, err := result.LastInsertId()
+	if err != nil {
+		return usage, err
+	}
+	usage.ID = int(usageID)
+
+	if err := insertUsageAllocations(tx, usage.ID, usage.Allocations); err != nil {
+		return usage, err
+	}
+
+	var expires sql.NullString
+	err = tx.QueryRow("SELECT usage_date, expires_at FROM CouponUsage WHERE id = ?", usage.ID).Scan(&usage.UsageDate, &expires)
+	usage.ExpiresAt = expires.String
+	return usage, err
+}
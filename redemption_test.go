@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connect to the MySQL database named by COUPONS_TEST_DSN, which must have schema.sql
+// applied. Tests needing a database are skipped when it is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("COUPONS_TEST_DSN")
+	if dsn == "" {
+		t.Skip("COUPONS_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Insert an active campaign and a coupon on it with the given usage limit
+func insertTestCoupon(t *testing.T, db *sql.DB, usageLimit int) int {
+	t.Helper()
+	now := time.Now()
+	campaignID, err := InsertCampaign(db, Campaign{
+		Name:      "redemption test",
+		StartDate: now.AddDate(0, 0, -1).Format(dateLayout),
+		EndDate:   now.AddDate(0, 0, 30).Format(dateLayout),
+		TimeZone:  "UTC",
+		IsActive:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.Exec("INSERT INTO Coupons (code, description, discount_type, discount_value, minimum_purchase, expiration_date, is_single_use, usage_limit, is_active, campaign_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		fmt.Sprintf("TEST%d", now.UnixNano()), "redemption test", "fixed", 5, 0, now.AddDate(0, 0, 30).Format(dateLayout), false, usageLimit, true, campaignID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	couponID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(couponID)
+}
+
+func TestRedeemConcurrentUsageLimit(t *testing.T) {
+	db := openTestDB(t)
+	const attempts, usageLimit = 25, 5
+	db.SetMaxOpenConns(attempts)
+	couponID := insertTestCoupon(t, db, usageLimit)
+
+	var wg sync.WaitGroup
+	errs := make([]error, attempts)
+	start := make(chan struct{})
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = Redeem(db, RedemptionRequest{CouponID: couponID, UserID: i + 1, OrderID: i + 1, DiscountAmount: 5})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var redeemed, limited int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			redeemed++
+		case errors.Is(err, ErrUsageLimitReached):
+			limited++
+		default:
+			t.Errorf("redemption %d: %v", i, err)
+		}
+	}
+	if redeemed != usageLimit || limited != attempts-usageLimit {
+		t.Errorf("got %d redemptions and %d limit errors, want %d and %d", redeemed, limited, usageLimit, attempts-usageLimit)
+	}
+
+	var rows int
+	err := db.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND status = ?", couponID, UsageStatusRedeemed).Scan(&rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != usageLimit {
+		t.Errorf("got %d redeemed rows, want %d", rows, usageLimit)
+	}
+}
+
+func TestRedeemReplays(t *testing.T) {
+	db := openTestDB(t)
+	couponID := insertTestCoupon(t, db, 0)
+
+	// Redeeming an order holding an open reservation commits the reservation
+	req := RedemptionRequest{CouponID: couponID, UserID: 1, OrderID: 1, DiscountAmount: 5}
+	reservation, err := Reserve(db, req, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := Redeem(db, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.ID != reservation.ID || usage.Status != UsageStatusRedeemed {
+		t.Errorf("got usage %d %s, want usage %d redeemed", usage.ID, usage.Status, reservation.ID)
+	}
+
+	// A key matching a released reservation does not replay as a success
+	keyed := RedemptionRequest{CouponID: couponID, UserID: 2, OrderID: 2, DiscountAmount: 5, IdempotencyKey: fmt.Sprintf("test-%d", time.Now().UnixNano())}
+	reservation, err = Reserve(db, keyed, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseReservation(db, reservation.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Redeem(db, keyed); !errors.Is(err, ErrReplayNotActive) {
+		t.Errorf("got %v, want ErrReplayNotActive", err)
+	}
+}
+
+func TestRedeemEnforcesRestrictions(t *testing.T) {
+	db := openTestDB(t)
+	couponID := insertTestCoupon(t, db, 0)
+	if err := InsertCouponRestriction(db, couponID, RestrictionChannel, ChannelPOS); err != nil {
+		t.Fatal(err)
+	}
+
+	req := RedemptionRequest{CouponID: couponID, UserID: 1, OrderID: 1, DiscountAmount: 5, SalesContext: SalesContext{Channel: ChannelWeb}}
+	if _, err := Redeem(db, req); !errors.Is(err, ErrRedemptionRestricted) {
+		t.Errorf("got %v, want ErrRedemptionRestricted", err)
+	}
+	req.Channel = ChannelPOS
+	if _, err := Redeem(db, req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedeemRejectsDeniedUser(t *testing.T) {
+	db := openTestDB(t)
+	couponID := insertTestCoupon(t, db, 0)
+	if _, err := AssignCouponToUsers(db, couponID, AssignmentDeny, []int{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Redeem(db, RedemptionRequest{CouponID: couponID, UserID: 1, OrderID: 1, DiscountAmount: 5})
+	var assignmentErr *AssignmentError
+	if !errors.As(err, &assignmentErr) || assignmentErr.Reason != ReasonUserDenied {
+		t.Fatalf("got %v, want an AssignmentError with reason %s", err, ReasonUserDenied)
+	}
+	if _, err := Redeem(db, RedemptionRequest{CouponID: couponID, UserID: 2, OrderID: 2, DiscountAmount: 5}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedeemWithoutOrderDoesNotReplay(t *testing.T) {
+	db := openTestDB(t)
+	couponID := insertTestCoupon(t, db, 0)
+
+	first, err := Redeem(db, RedemptionRequest{CouponID: couponID, UserID: 1, DiscountAmount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Redeem(db, RedemptionRequest{CouponID: couponID, UserID: 2, DiscountAmount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID {
+		t.Errorf("redemptions without an order both returned usage %d", first.ID)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultReservationTTL is how long a reservation holds a coupon when no TTL is given
+var DefaultReservationTTL = 15 * time.Minute
+
+var ErrReservationNotActive = errors.New("reservation is not active")
+
+// Reserve holds one use of a coupon for an order that has not been paid yet. The
+// reservation counts against the coupon's usage limit until it is committed,
+// released, or expires after ttl (DefaultReservationTTL when ttl is 0).
+func Reserve(db *sql.DB, req RedemptionRequest, ttl time.Duration) (CouponUsage, error) {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	defer tx.Rollback()
+
+	existing, replayed, grant, err := prepareUsage(tx, req)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	if replayed {
+		return existing, nil
+	}
+	if grant.Fraud.Decision == FraudBlock {
+		return recordBlockedUsage(tx, req, grant)
+	}
+
+	usage, err := insertCouponUsage(tx, req, grant, UsageStatusReserved, ttl)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return CouponUsage{}, err
+	}
+	return usage, nil
+}
+
+// CommitReservation turns an open reservation into a redemption once the order is
+// paid. Committing a reservation that was already committed succeeds again.
+func CommitReservation(db *sql.DB, usageID int) error {
+	result, err := db.Exec(commitReservationQuery, UsageStatusRedeemed, usageID, UsageStatusReserved)
+	if err != nil {
+		return err
+	}
+	if err := requireOneRow(result); err != ErrReservationNotActive {
+		return err
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM CouponUsage WHERE id = ?", usageID).Scan(&status); err != nil {
+		return err
+	}
+	if status == UsageStatusRedeemed {
+		return nil
+	}
+	return ErrReservationNotActive
+}
+
+// commitReservationQuery turns an open reservation into a redemption
+const commitReservationQuery = "UPDATE CouponUsage SET status = ?, is_used = true, usage_date = NOW(), expires_at = NULL " +
+	"WHERE id = ? AND status = ? AND expires_at > NOW()"
+
+// Commit an open reservation found by a replayed redemption within the redemption's
+// transaction and return it as the redemption
+func commitReplayedReservation(tx *sql.Tx, usage CouponUsage) (CouponUsage, error) {
+	result, err := tx.Exec(commitReservationQuery, UsageStatusRedeemed, usage.ID, UsageStatusReserved)
+	if err != nil {
+		return CouponUsage{}, err
+	}
+	if err := requireOneRow(result); err != nil {
+		return CouponUsage{}, err
+	}
+	usage.Status = UsageStatusRedeemed
+	usage.IsUsed = true
+	usage.ExpiresAt = ""
+	if err := tx.QueryRow("SELECT usage_date FROM CouponUsage WHERE id = ?", usage.ID).Scan(&usage.UsageDate); err != nil {
+		return CouponUsage{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return CouponUsage{}, err
+	}
+	return usage, nil
+}
+
+// ReleaseReservation gives the use held by an open reservation back to the coupon
+func ReleaseReservation(db *sql.DB, usageID int) error {
+	result, err := db.Exec("UPDATE CouponUsage SET status = ?, expires_at = NULL WHERE id = ? AND status = ?",
+		UsageStatusReleased, usageID, UsageStatusReserved)
+	if err != nil {
+		return err
+	}
+	return requireOneRow(result)
+}
+
+// ExpireReservations marks every reservation past its expiry as expired and returns how many were swept
+func ExpireReservations(db *sql.DB) (int64, error) {
+	result, err := db.Exec("UPDATE CouponUsage SET status = ? WHERE status = ? AND expires_at <= NOW()",
+		UsageStatusExpired, UsageStatusReserved)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartReservationSweeper expires stale reservations every interval until ctx is done
+func StartReservationSweeper(ctx context.Context, db *sql.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				swept, err := ExpireReservations(db)
+				if err != nil {
+					log.Printf("Error expiring coupon reservations: %s", err)
+					continue
+				}
+				if swept > 0 {
+					log.Printf("Expired %d coupon reservations", swept)
+				}
+			}
+		}
+	}()
+}
+
+// Fail with ErrReservationNotActive unless the update touched exactly one reservation
+func requireOneRow(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return ErrReservationNotActive
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Sales channels a coupon can be redeemed through
+const (
+	ChannelWeb        = "web"
+	ChannelApp        = "app"
+	ChannelPOS        = "pos"
+	ChannelCallCenter = "call_center"
+)
+
+// Kinds of restriction stored in Campaign_Restrictions and Coupon_Restrictions
+const (
+	RestrictionChannel = "channel"
+	RestrictionStore   = "store"
+	RestrictionRegion  = "region"
+)
+
+var ErrRedemptionRestricted = errors.New("coupon cannot be redeemed in this sales context")
+
+// RestrictionError is returned when redeeming a coupon through a channel, at a store or
+// in a region that the coupon or its campaign does not allow
+type RestrictionError struct {
+	CouponID int
+	Reason   ReasonCode
+}
+
+func (e *RestrictionError) Error() string {
+	return fmt.Sprintf("coupon %d cannot be redeemed in this sales context: %s", e.CouponID, e.Reason)
+}
+
+func (e *RestrictionError) Unwrap() error {
+	return ErrRedemptionRestricted
+}
+
+// Define a struct to represent where a redemption takes place
+type SalesContext struct {
+	Channel string
+	StoreID int
+	Country string // ISO 3166-1 alpha-2 code, e.g. US
+	Region  string // ISO 3166-2 code, e.g. US-CA
+}
+
+// Define a struct to represent where a coupon or campaign may be redeemed. An empty
+// list leaves that dimension unrestricted. Regions hold country codes (US) or
+// subdivision codes (US-CA).
+type Restrictions struct {
+	Channels []string
+	StoreIDs []int
+	Regions  []string
+}
+
+// Check returns the reason the sales context is not allowed, or ReasonNone
+func (r Restrictions) Check(sales SalesContext) ReasonCode {
+	if len(r.Channels) > 0 && !containsFold(r.Channels, sales.Channel) {
+		return ReasonChannelNotAllowed
+	}
+	if len(r.StoreIDs) > 0 && !containsInt(r.StoreIDs, sales.StoreID) {
+		return ReasonStoreNotAllowed
+	}
+	if len(r.Regions) > 0 && !containsFold(r.Regions, sales.Country) && !containsFold(r.Regions, sales.Region) {
+		return ReasonRegionNotAllowed
+	}
+	return ReasonNone
+}
+
+// Report whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether values holds value
+func containsInt(values []int, value int) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieve the redemption restrictions of a coupon
+func GetCouponRestrictions(db queryer, couponID int) (Restrictions, error) {
+	return queryRestrictions(db, "SELECT restriction_type, value FROM Coupon_Restrictions WHERE coupon_id = ?", couponID)
+}
+
+// Retrieve the redemption restrictions of a campaign
+func GetCampaignRestrictions(db queryer, campaignID int) (Restrictions, error) {
+	return queryRestrictions(db, "SELECT restriction_type, value FROM Campaign_Restrictions WHERE campaign_id = ?", campaignID)
+}
+
+// Fail with a *RestrictionError when the campaign or the coupon of a redemption does
+// not allow its sales context
+func checkRestrictions(tx *sql.Tx, req RedemptionRequest, campaignID int) error {
+	campaign, err := GetCampaignRestrictions(tx, campaignID)
+	if err != nil {
+		return err
+	}
+	if reason := campaign.Check(req.SalesContext); reason != ReasonNone {
+		return &RestrictionError{CouponID: req.CouponID, Reason: reason}
+	}
+
+	coupon, err := GetCouponRestrictions(tx, req.CouponID)
+	if err != nil {
+		return err
+	}
+	if reason := coupon.Check(req.SalesContext); reason != ReasonNone {
+		return &RestrictionError{CouponID: req.CouponID, Reason: reason}
+	}
+	return nil
+}
+
+// Load restriction rows into Restrictions
+func queryRestrictions(db queryer, query string, id int) (Restrictions, error) {
+	var restrictions Restrictions
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return restrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var restrictionType, value string
+		if err := rows.Scan(&restrictionType, &value); err != nil {
+			return restrictions, err
+		}
+		switch restrictionType {
+		case RestrictionChannel:
+			restrictions.Channels = append(restrictions.Channels, value)
+		case RestrictionStore:
+			storeID, err := strconv.Atoi(value)
+			if err != nil {
+				return restrictions, err
+			}
+			restrictions.StoreIDs = append(restrictions.StoreIDs, storeID)
+		case RestrictionRegion:
+			restrictions.Regions = append(restrictions.Regions, value)
+		}
+	}
+	return restrictions, rows.Err()
+}
+
+// Insert a restriction for a coupon
+func InsertCouponRestriction(db execer, couponID int, restrictionType, value string) error {
+	_, err := db.Exec("INSERT INTO Coupon_Restrictions (coupon_id, restriction_type, value) VALUES (?, ?, ?)",
+		couponID, restrictionType, value)
+	return err
+}
+
+// Insert a restriction for a campaign
+func InsertCampaignRestriction(db execer, campaignID int, restrictionType, value string) error {
+	_, err := db.Exec("INSERT INTO Campaign_Restrictions (campaign_id, restriction_type, value) VALUES (?, ?, ?)",
+		campaignID, restrictionType, value)
+	return err
+}
+
+// Insert every channel, store and region restriction of a campaign
+func insertCampaignRestrictions(db execer, campaignID int, restrictions Restrictions) error {
+	for _, channel := range restrictions.Channels {
+		if err := InsertCampaignRestriction(db, campaignID, RestrictionChannel, channel); err != nil {
+			return err
+		}
+	}
+	for _, storeID := range restrictions.StoreIDs {
+		if err := InsertCampaignRestriction(db, campaignID, RestrictionStore, strconv.Itoa(storeID)); err != nil {
+			return err
+		}
+	}
+	for _, region := range restrictions.Regions {
+		if err := InsertCampaignRestriction(db, campaignID, RestrictionRegion, region); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestRestrictionsCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		restrictions Restrictions
+		sales        SalesContext
+		want         ReasonCode
+	}{
+		{"unrestricted", Restrictions{}, SalesContext{Channel: "web", Country: "US"}, ReasonNone},
+		{"allowed channel", Restrictions{Channels: []string{"web", "app"}}, SalesContext{Channel: "APP"}, ReasonNone},
+		{"denied channel", Restrictions{Channels: []string{"web"}}, SalesContext{Channel: "pos"}, ReasonChannelNotAllowed},
+		{"missing channel", Restrictions{Channels: []string{"web"}}, SalesContext{}, ReasonChannelNotAllowed},
+		{"allowed store", Restrictions{StoreIDs: []int{7, 9}}, SalesContext{StoreID: 9}, ReasonNone},
+		{"denied store", Restrictions{StoreIDs: []int{7}}, SalesContext{StoreID: 8}, ReasonStoreNotAllowed},
+		{"allowed country", Restrictions{Regions: []string{"US"}}, SalesContext{Country: "us", Region: "US-CA"}, ReasonNone},
+		{"allowed region", Restrictions{Regions: []string{"US-CA"}}, SalesContext{Country: "US", Region: "US-CA"}, ReasonNone},
+		{"denied region", Restrictions{Regions: []string{"US-CA"}}, SalesContext{Country: "US", Region: "US-NY"}, ReasonRegionNotAllowed},
+		{"denied country", Restrictions{Regions: []string{"US", "CA"}}, SalesContext{Country: "MX"}, ReasonRegionNotAllowed},
+		{"channel checked first", Restrictions{Channels: []string{"web"}, Regions: []string{"US"}}, SalesContext{Channel: "pos", Country: "MX"}, ReasonChannelNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.restrictions.Check(test.sales); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// UsageStatusReversed marks a redemption that was fully undone
+const UsageStatusReversed = "reversed"
+
+// Reversal policies decide whether undoing a redemption gives the use back to the coupon
+const (
+	ReversalPolicyRestore = "restore"
+	ReversalPolicyConsume = "consume"
+)
+
+var (
+	ErrUsageNotRedeemed        = errors.New("coupon usage is not an active redemption")
+	ErrReversalExceedsDiscount = errors.New("reversal exceeds the discount left on the redemption")
+)
+
+// Define a struct to represent an audited reversal of a coupon redemption
+type Reversal struct {
+	ID               int
+	UsageID          int
+	Amount           float64
+	Reason           string
+	IsFull           bool
+	CapacityRestored bool
+	ReversedAt       string
+}
+
+// ReverseRedemption undoes a redemption completely, e.g. when the order is cancelled
+func ReverseRedemption(db *sql.DB, usageID int, reason string) (Reversal, error) {
+	return reverseRedemption(db, usageID, 0, reason)
+}
+
+// PartiallyReverseRedemption undoes amount of the discount of a redemption, e.g. when
+// part of the order is refunded. Reversing the last of the discount completes the
+// reversal as ReverseRedemption would.
+func PartiallyReverseRedemption(db *sql.DB, usageID int, amount float64, reason string) (Reversal, error) {
+	if amount <= 0 {
+		return Reversal{}, fmt.Errorf("%w: %.2f", ErrReversalExceedsDiscount, amount)
+	}
+	return reverseRedemption(db, usageID, amount, reason)
+}
+
+// reverseRedemption reverses amount of a redemption, or all that is left when amount is 0
+func reverseRedemption(db *sql.DB, usageID int, amount float64, reason string) (Reversal, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Reversal{}, err
+	}
+	defer tx.Rollback()
+
+	usage, err := lockUsageForReversal(tx, usageID)
+	if err != nil {
+		return Reversal{}, err
+	}
+	reversal, err := usage.reverse(tx, amount, reason)
+	if err != nil {
+		return Reversal{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Reversal{}, err
+	}
+	return reversal, nil
+}
+
+// Define a struct to represent a redemption locked for reversal
+type reversibleUsage struct {
+	ID       int
+	Policy   string
+	Status   string
+	Discount float64
+	Reversed float64
+}
+
+// Remaining returns the discount of the redemption that is not reversed yet
+func (u reversibleUsage) Remaining() float64 {
+	return fromCents(toCents(u.Discount) - toCents(u.Reversed))
+}
+
+// Lock a redemption, and the coupon it belongs to, for reversal
+func lockUsageForReversal(tx *sql.Tx, usageID int) (reversibleUsage, error) {
+	usage := reversibleUsage{ID: usageID}
+
+	// Lock the coupon before the usage, in the same order as redemptions do
+	var couponID int
+	if err := tx.QueryRow("SELECT coupon_id FROM CouponUsage WHERE id = ?", usageID).Scan(&couponID); err != nil {
+		return usage, err
+	}
+	if err := tx.QueryRow("SELECT reversal_policy FROM Coupons WHERE id = ? FOR UPDATE", couponID).Scan(&usage.Policy); err != nil {
+		return usage, err
+	}
+
+	err := tx.QueryRow("SELECT status, discount_amount, reversed_amount FROM CouponUsage WHERE id = ? FOR UPDATE", usageID).
+		Scan(&usage.Status, &usage.Discount, &usage.Reversed)
+	return usage, err
+}
+
+// reverse reverses amount of a locked redemption, or all that is left when amount is 0.
+// A complete reversal marks the usage as reversed and, when the coupon's reversal policy
+// allows it, stops the usage from counting against the coupon's limits.
+func (u reversibleUsage) reverse(tx *sql.Tx, amount float64, reason string) (Reversal, error) {
+	if u.Status != UsageStatusRedeemed {
+		return Reversal{}, ErrUsageNotRedeemed
+	}
+
+	remainingCents := toCents(u.Remaining())
+	amountCents := toCents(amount)
+	if amountCents == 0 {
+		amountCents = remainingCents
+	}
+	if amountCents > remainingCents {
+		return Reversal{}, fmt.Errorf("%w: %.2f > %.2f", ErrReversalExceedsDiscount, fromCents(amountCents), fromCents(remainingCents))
+	}
+
+	reversal := Reversal{
+		UsageID: u.ID,
+		Amount:  fromCents(amountCents),
+		Reason:  reason,
+		IsFull:  amountCents == remainingCents,
+	}
+	reversal.CapacityRestored = reversal.IsFull && u.Policy != ReversalPolicyConsume
+
+	var err error
+	if reversal.IsFull {
+		_, err = tx.Exec("UPDATE CouponUsage SET status = ?, is_used = ?, reversed_amount = discount_amount WHERE id = ?",
+			UsageStatusReversed, !reversal.CapacityRestored, u.ID)
+	} else {
+		_, err = tx.Exec("UPDATE CouponUsage SET reversed_amount = reversed_amount + ? WHERE id = ?",
+			reversal.Amount, u.ID)
+	}
+	if err != nil {
+		return Reversal{}, err
+	}
+
+	result, err := tx.Exec("INSERT INTO CouponUsageReversals (usage_id, amount, reason, is_full, capacity_restored, reversed_at) VALUES (?, ?, ?, ?, ?, NOW())",
+		u.ID, reversal.Amount, reversal.Reason, reversal.IsFull, reversal.CapacityRestored)
+	if err != nil {
+		return Reversal{}, err
+	}
+	reversalID, err := result.LastInsertId()
+	if err != nil {
+		return Reversal{}, err
+	}
+	reversal.ID = int(reversalID)
+	return reversal, nil
+}
+
+// Retrieve the reversal history of a coupon usage, oldest first
+func GetUsageReversals(db *sql.DB, usageID int) ([]Reversal, error) {
+	rows, err := db.Query("SELECT id, usage_id, amount, reason, is_full, capacity_restored, reversed_at FROM CouponUsageReversals WHERE usage_id = ? ORDER BY id", usageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reversals []Reversal
+	for rows.Next() {
+		var reversal Reversal
+		if err := rows.Scan(&reversal.ID, &reversal.UsageID, &reversal.Amount, &reversal.Reason, &reversal.IsFull, &reversal.CapacityRestored, &reversal.ReversedAt); err != nil {
+			return nil, err
+		}
+		reversals = append(reversals, reversal)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reversals, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/hyperjumptech/grule-rule-engine/pkg"
+)
+
+// ErrMissingOrderContext is returned when rules are evaluated without order facts. An
+// evaluation with no order to speak of passes an empty OrderContext explicitly.
+var ErrMissingOrderContext = errors.New("rule facts have no order context")
+
+// DefaultRuleEngine is the rule engine shared by ApplyRuleset and ValidateCoupon
+var DefaultRuleEngine = NewRuleEngine()
+
+// RuleEngine compiles rulesets once and keeps their knowledge bases cached by name and
+// version. It is safe for concurrent use: evaluations read an immutable snapshot of
+// the cache, and new rulesets are swapped in atomically, so an evaluation sees either
+// all or none of the rulesets installed by one Swap.
+type RuleEngine struct {
+	mu       sync.Mutex   // serializes writers; readers only load snapshot
+	snapshot atomic.Value // *ruleSnapshot
+	shadows  sync.WaitGroup
+}
+
+// Define a struct to represent the compiled rulesets a RuleEngine holds at one moment
+type ruleSnapshot struct {
+	compiled map[string]*compiledRuleset // keyed by rulesetKey
+	active   map[string]string           // ruleset name to active version
+	shadows  map[string]*shadowRun       // ruleset name to shadow version
+}
+
+// Define a struct to represent a parsed ruleset and the knowledge bases cloned from it
+type compiledRuleset struct {
+	RuleSet
+	template *ast.KnowledgeBase
+	pool     sync.Pool
+}
+
+// NewRuleEngine returns a rule engine with an empty cache
+func NewRuleEngine() *RuleEngine {
+	e := &RuleEngine{}
+	e.snapshot.Store(&ruleSnapshot{compiled: map[string]*compiledRuleset{}, active: map[string]string{}, shadows: map[string]*shadowRun{}})
+	return e
+}
+
+// Cache key of a ruleset version
+func rulesetKey(name, version string) string {
+	return name + ":" + version
+}
+
+// Parse a ruleset definition into a knowledge base template, failing with a
+// *RulesetError instead of panicking when the definition is not valid GRL
+func compileRuleset(ruleset RuleSet) (*compiledRuleset, error) {
+	template, diagnostics := buildKnowledgeBase(ruleset)
+	if len(diagnostics) > 0 {
+		return nil, &RulesetError{Ruleset: ruleset.Name, Version: ruleset.Version, Diagnostics: diagnostics}
+	}
+	return &compiledRuleset{RuleSet: ruleset, template: template}, nil
+}
+
+// Take a knowledge base for one evaluation. Knowledge bases hold working memory, so
+// each is used by one evaluation at a time and returned with release afterwards.
+func (c *compiledRuleset) acquire() (*ast.KnowledgeBase, error) {
+	if knowledgeBase, ok := c.pool.Get().(*ast.KnowledgeBase); ok {
+		return knowledgeBase, nil
+	}
+	return c.template.Clone(pkg.NewCloneTable())
+}
+
+// Return a knowledge base taken with acquire
+func (c *compiledRuleset) release(knowledgeBase *ast.KnowledgeBase) {
+	c.pool.Put(knowledgeBase)
+}
+
+// Swap compiles rulesets and installs them as the active version of their names in one
+// step. Nothing is installed when any of them fails to compile.
+func (e *RuleEngine) Swap(rulesets ...RuleSet) error {
+	compiled := make([]*compiledRuleset, 0, len(rulesets))
+	for _, ruleset := range rulesets {
+		c, err := compileRuleset(ruleset)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, c)
+	}
+	e.install(compiled, true)
+	return nil
+}
+
+// Compile parses rulesets ahead of their first evaluation and caches them without
+// changing the active versions. Nothing is cached when any of them fails to compile.
+func (e *RuleEngine) Compile(rulesets ...RuleSet) error {
+	compiled := make([]*compiledRuleset, 0, len(rulesets))
+	for _, ruleset := range rulesets {
+		c, err := compileRuleset(ruleset)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, c)
+	}
+	e.install(compiled, false)
+	return nil
+}
+
+// Activate makes an already compiled version the active version of a ruleset
+func (e *RuleEngine) Activate(name, version string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := e.snapshot.Load().(*ruleSnapshot)
+	if _, ok := current.compiled[rulesetKey(name, version)]; !ok {
+		return fmt.Errorf("ruleset %s v%s is not compiled", name, version)
+	}
+	next := current.copy()
+	next.active[name] = version
+	e.snapshot.Store(next)
+	return nil
+}
+
+// Active returns the active version of a ruleset
+func (e *RuleEngine) Active(name string) (RuleSet, bool) {
+	current := e.snapshot.Load().(*ruleSnapshot)
+	version, ok := current.active[name]
+	if !ok {
+		return RuleSet{}, false
+	}
+	return current.compiled[rulesetKey(name, version)].RuleSet, true
+}
+
+// Evict drops a compiled ruleset version from the cache
+func (e *RuleEngine) Evict(name, version string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	next := e.snapshot.Load().(*ruleSnapshot).copy()
+	delete(next.compiled, rulesetKey(name, version))
+	if next.active[name] == version {
+		delete(next.active, name)
+	}
+	e.snapshot.Store(next)
+}
+
+// Add compiled rulesets to the cache, optionally making them the active versions
+func (e *RuleEngine) install(compiled []*compiledRuleset, activate bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	next := e.snapshot.Load().(*ruleSnapshot).copy()
+	for _, c := range compiled {
+		next.compiled[rulesetKey(c.Name, c.Version)] = c
+		if activate {
+			next.active[c.Name] = c.Version
+		}
+	}
+	e.snapshot.Store(next)
+}
+
+// Copy a snapshot so it can be changed without affecting concurrent readers
+func (s *ruleSnapshot) copy() *ruleSnapshot {
+	next := &ruleSnapshot{
+		compiled: make(map[string]*compiledRuleset, len(s.compiled)+1),
+		active:   make(map[string]string, len(s.active)+1),
+		shadows:  make(map[string]*shadowRun, len(s.shadows)+1),
+	}
+	for key, c := range s.compiled {
+		next.compiled[key] = c
+	}
+	for name, version := range s.active {
+		next.active[name] = version
+	}
+	for name, run := range s.shadows {
+		next.shadows[name] = run
+	}
+	return next
+}
+
+// compile returns the compiled form of rulesets, parsing only those not cached yet. A
+// ruleset without a definition refers to the active version of its name; a cached
+// version whose definition changed is compiled again and replaces the old one.
+func (e *RuleEngine) compile(rulesets []RuleSet) ([]*compiledRuleset, error) {
+	current := e.snapshot.Load().(*ruleSnapshot)
+
+	compiled := make([]*compiledRuleset, len(rulesets))
+	var missing []*compiledRuleset
+	for i, ruleset := range rulesets {
+		if ruleset.Definition == "" {
+			version, ok := current.active[ruleset.Name]
+			if !ok {
+				return nil, fmt.Errorf("ruleset %s has no definition and no active version", ruleset.Name)
+			}
+			compiled[i] = current.compiled[rulesetKey(ruleset.Name, version)]
+			continue
+		}
+		if c, ok := current.compiled[rulesetKey(ruleset.Name, ruleset.Version)]; ok && c.Definition == ruleset.Definition {
+			compiled[i] = c
+			continue
+		}
+		c, err := compileRuleset(ruleset)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = c
+		missing = append(missing, c)
+	}
+
+	if len(missing) > 0 {
+		e.install(missing, false)
+	}
+	return compiled, nil
+}
+
+// Evaluate runs rulesets in order against a single coupon and reports the outcome of
+// each ruleset. It fails when a ruleset cannot be compiled or orderContext is nil.
+func (e *RuleEngine) Evaluate(rulesets []RuleSet, coupon *Coupon, customerContext *CustomerContext, changeContext *ChangeContext, optionsContext *OptionsContext, orderContext *OrderContext) (CouponEvaluation, error) {
+	return e.EvaluateAttached(attachAll(rulesets), coupon, customerContext, changeContext, optionsContext, orderContext)
+}
+
+// Attach rulesets passed in directly in all mode, so each of them must pass
+func attachAll(rulesets []RuleSet) []AttachedRuleset {
+	attached := make([]AttachedRuleset, len(rulesets))
+	for i, ruleset := range rulesets {
+		attached[i] = AttachedRuleset{RuleSet: ruleset, Mode: RulesetModeAll}
+	}
+	return attached
+}
+
+// EvaluateAttached runs rulesets attached to a campaign and coupon against a single
+// coupon. Attachments are evaluated in the order given, except that within a scope
+// the rulesets in any mode are evaluated together after those in all mode, as one
+// step that passes when one of them leaves the coupon valid. It fails when a ruleset
+// cannot be compiled or orderContext is nil.
+func (e *RuleEngine) EvaluateAttached(attached []AttachedRuleset, coupon *Coupon, customerContext *CustomerContext, changeContext *ChangeContext, optionsContext *OptionsContext, orderContext *OrderContext) (CouponEvaluation, error) {
+	return e.EvaluateFacts(attached, RuleFacts{Coupon: coupon, CustomerContext: customerContext, ChangeContext: changeContext, OptionsContext: optionsContext, OrderContext: orderContext})
+}
+
+// EvaluateFacts runs attached rulesets against a single coupon like EvaluateAttached,
+// also taking the time zone and moment the rule helpers read
+func (e *RuleEngine) EvaluateFacts(attached []AttachedRuleset, facts RuleFacts) (CouponEvaluation, error) {
+	if facts.OrderContext == nil {
+		return CouponEvaluation{}, ErrMissingOrderContext
+	}
+	rulesets := make([]RuleSet, len(attached))
+	for i, a := range attached {
+		rulesets[i] = a.RuleSet
+	}
+	compiled, err := e.compile(rulesets)
+	if err != nil {
+		return CouponEvaluation{}, err
+	}
+	return e.evaluateCompiled(attached, compiled, facts), nil
+}
+
+// Evaluate compiled attached rulesets, running any shadow versions alongside
+func (e *RuleEngine) evaluateCompiled(attached []AttachedRuleset, compiled []*compiledRuleset, facts RuleFacts) CouponEvaluation {
+	finish := e.startShadows(attached, compiled, facts)
+	evaluation := evaluateStages(attachmentStages(attached, compiled), facts)
+	finish(evaluation)
+	return evaluation
+}
+
+// Group compiled attached rulesets into evaluation stages: per scope, in order of first
+// appearance, a stage for every ruleset in all mode followed by one stage holding the
+// rulesets in any mode
+func attachmentStages(attached []AttachedRuleset, compiled []*compiledRuleset) []rulesetStage {
+	var stages []rulesetStage
+	var scope string
+	var group *rulesetStage
+	flush := func() {
+		if group != nil {
+			stages = append(stages, *group)
+			group = nil
+		}
+	}
+
+	for i, a := range attached {
+		if i == 0 || a.Scope != scope {
+			flush()
+			scope = a.Scope
+		}
+		if a.Mode == RulesetModeAny {
+			if group == nil {
+				group = &rulesetStage{Scope: a.Scope, Mode: RulesetModeAny}
+			}
+			group.Rulesets = append(group.Rulesets, compiled[i])
+			continue
+		}
+		stages = append(stages, rulesetStage{Rulesets: []*compiledRuleset{compiled[i]}, Scope: a.Scope, Mode: RulesetModeAll})
+	}
+	flush()
+	return stages
+}
+
+// EvaluateCoupons runs rulesets against every coupon, changing the coupons in place,
+// and returns one evaluation per coupon. Each coupon is evaluated with its own copy of
+// the contexts, the order included. It fails only when a ruleset cannot be compiled.
+func (e *RuleEngine) EvaluateCoupons(rulesets []RuleSet, coupons []Coupon, customerContext CustomerContext, changeContext ChangeContext, optionsContext OptionsContext, orderContext OrderContext) ([]CouponEvaluation, error) {
+	compiled, err := e.compile(rulesets)
+	if err != nil {
+		return nil, err
+	}
+
+	attached := attachAll(rulesets)
+	evaluations := make([]CouponEvaluation, len(coupons))
+	for i := range coupons {
+		customer, change, options, order := customerContext, changeContext, optionsContext, orderContext
+		evaluations[i] = e.evaluateCompiled(attached, compiled, RuleFacts{Coupon: &coupons[i], CustomerContext: &customer, ChangeContext: &change, OptionsContext: &options, OrderContext: &order})
+	}
+	return evaluations, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEvaluationsReadOrderFacts(t *testing.T) {
+	rulesets := []RuleSet{{
+		Name:    "OrderFactsTest",
+		Version: "1",
+		Definition: `rule NeedsShoes "The order must hold shoes" {
+			when
+				!OrderContext.HasCategory("shoes")
+			then
+				Coupon.Reject("NOT_ELIGIBLE_SKU", "No shoes in the order.");
+				Retract("NeedsShoes");
+		}`,
+	}}
+	shoes := NewOrderContext([]OrderLine{{SKUID: 1, Category: "shoes", Quantity: 1, UnitPrice: 60}}, 0)
+
+	for _, test := range []struct {
+		order OrderContext
+		valid bool
+	}{{shoes, true}, {OrderContext{}, false}} {
+		coupons := []Coupon{{Code: "SHOES", IsValid: true}}
+		evaluations, err := ApplyRuleset(rulesets, coupons, CustomerContext{}, ChangeContext{}, OptionsContext{}, test.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evaluations[0].Valid != test.valid {
+			t.Errorf("order with %d lines: got valid %v, want %v", len(test.order.Lines), evaluations[0].Valid, test.valid)
+		}
+	}
+
+	coupon := Coupon{Code: "SHOES", IsValid: true}
+	_, err := DefaultRuleEngine.Evaluate(rulesets, &coupon, &CustomerContext{}, &ChangeContext{}, &OptionsContext{}, nil)
+	if !errors.Is(err, ErrMissingOrderContext) {
+		t.Errorf("got %v, want ErrMissingOrderContext", err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Define a struct to represent a fixture file: a ruleset and the cases to run it
+// against. The ruleset is given inline or, with RulesetFile, as a GRL file whose path
+// is relative to the fixture file; its name defaults to the file name.
+type RulesetFixture struct {
+	Ruleset     RuleSet
+	RulesetFile string
+	Cases       []FixtureCase
+}
+
+// Define a struct to represent one case of a fixture: the facts rules run against
+// and what the rules are expected to make of them
+type FixtureCase struct {
+	Name            string
+	Coupon          Coupon
+	CustomerContext CustomerContext
+	ChangeContext   ChangeContext
+	OptionsContext  OptionsContext
+	OrderContext    OrderContext
+	Expect          FixtureExpectation
+}
+
+// Define a struct to represent the expected outcome of a fixture case. Unset
+// expectations are not checked. Fields maps fact fields, e.g. "Coupon.DiscountValue",
+// to the value they must hold after the rules ran.
+type FixtureExpectation struct {
+	Valid   *bool
+	Reason  ReasonCode
+	Message string
+	Rule    string
+	Fields  map[string]json.RawMessage
+}
+
+// Define a struct to represent the outcome of a fixture case
+type FixtureCaseResult struct {
+	Name       string
+	Failures   []string
+	Evaluation CouponEvaluation
+}
+
+// Passed reports whether the case met all its expectations
+func (r FixtureCaseResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Define a struct to represent the outcome of a fixture file. Err is set when the
+// fixture could not be loaded or its ruleset does not compile.
+type FixtureReport struct {
+	Path  string
+	Cases []FixtureCaseResult
+	Err   error
+}
+
+// Passed reports whether the fixture loaded and all its cases passed
+func (r FixtureReport) Passed() bool {
+	if r.Err != nil {
+		return false
+	}
+	for _, c := range r.Cases {
+		if !c.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadRulesetFixture reads a fixture file, in YAML when its extension is .yaml or .yml
+// and in JSON otherwise. Both use the field names of RulesetFixture.
+func LoadRulesetFixture(path string) (RulesetFixture, error) {
+	var fixture RulesetFixture
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fixture, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return fixture, fmt.Errorf("reading fixture %s: %w", path, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fixture); err != nil {
+		return fixture, fmt.Errorf("reading fixture %s: %w", path, err)
+	}
+
+	// Derive the order totals, SKUs and categories the case does not spell out
+	for i := range fixture.Cases {
+		if order := &fixture.Cases[i].OrderContext; len(order.Lines) > 0 {
+			order.derive()
+		}
+	}
+
+	if fixture.RulesetFile != "" {
+		rulesetPath := filepath.Join(filepath.Dir(path), fixture.RulesetFile)
+		definition, err := os.ReadFile(rulesetPath)
+		if err != nil {
+			return fixture, err
+		}
+		fixture.Ruleset.Definition = string(definition)
+		if fixture.Ruleset.Name == "" {
+			fixture.Ruleset.Name = strings.TrimSuffix(filepath.Base(rulesetPath), filepath.Ext(rulesetPath))
+		}
+	}
+	return fixture, nil
+}
+
+// Convert a YAML document to JSON so YAML fixtures decode exactly like JSON ones
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// RunRulesetFixture runs every case of a fixture against its ruleset
+func RunRulesetFixture(fixture RulesetFixture) FixtureReport {
+	var report FixtureReport
+	ruleEngine := NewRuleEngine()
+	if err := ruleEngine.Compile(fixture.Ruleset); err != nil {
+		report.Err = err
+		return report
+	}
+
+	rulesets := []RuleSet{fixture.Ruleset}
+	for _, c := range fixture.Cases {
+		result := FixtureCaseResult{Name: c.Name}
+		facts := RuleFacts{Coupon: &c.Coupon, CustomerContext: &c.CustomerContext, ChangeContext: &c.ChangeContext, OptionsContext: &c.OptionsContext, OrderContext: &c.OrderContext}
+		evaluation, err := ruleEngine.EvaluateFacts(attachAll(rulesets), facts)
+		if err != nil {
+			report.Err = err
+			return report
+		}
+		result.Evaluation = evaluation
+		result.Failures = c.Expect.check(evaluation, facts)
+		report.Cases = append(report.Cases, result)
+	}
+	return report
+}
+
+// RunRulesetFixtureFiles loads and runs the fixture files matching the glob patterns
+func RunRulesetFixtureFiles(patterns ...string) ([]FixtureReport, error) {
+	var reports []FixtureReport
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no fixture files match %s", pattern)
+		}
+		for _, path := range paths {
+			fixture, err := LoadRulesetFixture(path)
+			report := FixtureReport{Err: err}
+			if err == nil {
+				report = RunRulesetFixture(fixture)
+			}
+			report.Path = path
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// Compare an evaluation and the facts the rules left behind with the expectation
+func (e FixtureExpectation) check(evaluation CouponEvaluation, facts RuleFacts) []string {
+	var failures []string
+	if evaluation.Err != nil {
+		failures = append(failures, evaluation.Err.Error())
+	}
+	if e.Valid != nil && evaluation.Valid != *e.Valid {
+		failures = append(failures, fmt.Sprintf("valid: got %t, want %t", evaluation.Valid, *e.Valid))
+	}
+	if e.Reason != "" && evaluation.Reason != e.Reason {
+		failures = append(failures, fmt.Sprintf("reason: got %q, want %q", evaluation.Reason, e.Reason))
+	}
+	if e.Message != "" && evaluation.Message != e.Message {
+		failures = append(failures, fmt.Sprintf("message: got %q, want %q", evaluation.Message, e.Message))
+	}
+	if e.Rule != "" && evaluation.Rule != e.Rule {
+		failures = append(failures, fmt.Sprintf("rule: got %q, want %q", evaluation.Rule, e.Rule))
+	}
+
+	for field, want := range e.Fields {
+		got, err := factField(facts, field)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		if !sameJSON(got, want) {
+			encoded, _ := json.Marshal(got)
+			failures = append(failures, fmt.Sprintf("%s: got %s, want %s", field, encoded, want))
+		}
+	}
+	return failures
+}
+
+// Look up a fact field by its dotted path, e.g. Coupon.DiscountValue
+func factField(facts RuleFacts, path string) (interface{}, error) {
+	parts := strings.Split(path, ".")
+	values := map[string]interface{}{
+		"Coupon":          facts.Coupon,
+		"CustomerContext": facts.CustomerContext,
+		"ChangeContext":   facts.ChangeContext,
+		"OptionsContext":  facts.OptionsContext,
+		"OrderContext":    facts.OrderContext,
+	}
+	fact, ok := values[parts[0]]
+	if !ok || len(parts) < 2 {
+		return nil, fmt.Errorf("%s: unknown fact field", path)
+	}
+
+	value := reflect.ValueOf(fact).Elem()
+	for _, name := range parts[1:] {
+		if value.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%s: unknown fact field", path)
+		}
+		value = value.FieldByName(name)
+		if !value.IsValid() || !value.CanInterface() {
+			return nil, fmt.Errorf("%s: unknown fact field", path)
+		}
+	}
+	return value.Interface(), nil
+}
+
+// Compare a value with a JSON document by their JSON forms
+func sameJSON(value interface{}, want json.RawMessage) bool {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	var got, expected interface{}
+	if json.Unmarshal(encoded, &got) != nil || json.Unmarshal(want, &expected) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, expected)
+}
+
+// FixtureTestingT is the part of *testing.T CheckRulesetFixtures reports through
+type FixtureTestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// CheckRulesetFixtures runs the fixture files matching the glob patterns and reports
+// every failing case to t, so rulesets can be tested with go test:
+//
+//	func TestRulesets(t *testing.T) {
+//		CheckRulesetFixtures(t, "testdata/rulesets/*.json", "testdata/rulesets/*.yaml")
+//	}
+func CheckRulesetFixtures(t FixtureTestingT, patterns ...string) {
+	t.Helper()
+	reports, err := RunRulesetFixtureFiles(patterns...)
+	if err != nil {
+		t.Errorf("%s", err)
+		return
+	}
+	for _, report := range reports {
+		if report.Err != nil {
+			t.Errorf("%s: %s", report.Path, report.Err)
+			continue
+		}
+		for _, c := range report.Cases {
+			for _, failure := range c.Failures {
+				t.Errorf("%s: %s: %s", report.Path, c.Name, failure)
+			}
+		}
+	}
+}
+
+// Print fixture reports case by case and return how many cases passed and failed
+func WriteFixtureReports(w io.Writer, reports []FixtureReport) (passed, failed int) {
+	for _, report := range reports {
+		if report.Err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", report.Path, report.Err)
+			failed++
+			continue
+		}
+		for _, c := range report.Cases {
+			if c.Passed() {
+				fmt.Fprintf(w, "PASS %s: %s\n", report.Path, c.Name)
+				passed++
+				continue
+			}
+			fmt.Fprintf(w, "FAIL %s: %s\n", report.Path, c.Name)
+			for _, failure := range c.Failures {
+				fmt.Fprintf(w, "    %s\n", failure)
+			}
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "%d passed, %d failed\n", passed, failed)
+	return passed, failed
+}
+
+// Run the test-rules command: run the fixture files matching the arguments and
+// return the process exit code
+func runTestRulesCommand(w io.Writer, patterns []string) int {
+	if len(patterns) == 0 {
+		fmt.Fprintln(w, "usage: coupons test-rules <fixture.json|fixture.yaml>...")
+		return 2
+	}
+	reports, err := RunRulesetFixtureFiles(patterns...)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 2
+	}
+	if _, failed := WriteFixtureReports(w, reports); failed > 0 {
+		return 1
+	}
+	return 0
+}
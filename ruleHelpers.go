@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Layouts redemption dates in a customer's history may come in
+var redemptionDateLayouts = []string{"2006-01-02 15:04:05", time.RFC3339, dateLayout}
+
+// RuleHelpers is added to every rule evaluation as the Helpers fact. Its methods can
+// be called from GRL, e.g.
+//
+//	when Helpers.HasRedeemed("SUMMER25") && Helpers.CartCategoryTotal("shoes") >= 100
+type RuleHelpers struct {
+	coupon   *Coupon
+	customer *CustomerContext
+	order    *OrderContext
+	location *time.Location
+	at       time.Time
+}
+
+// Build the helpers reading the given facts
+func newRuleHelpers(facts RuleFacts) *RuleHelpers {
+	helpers := &RuleHelpers{
+		coupon:   facts.Coupon,
+		customer: facts.CustomerContext,
+		order:    facts.OrderContext,
+		location: facts.Location,
+		at:       facts.At,
+	}
+	if helpers.order == nil {
+		helpers.order = &OrderContext{}
+	}
+	if helpers.location == nil {
+		helpers.location = time.UTC
+	}
+	if helpers.at.IsZero() {
+		helpers.at = time.Now()
+	}
+	return helpers
+}
+
+// Now returns the moment of the order in the campaign's time zone
+func (h *RuleHelpers) Now() time.Time {
+	return h.at.In(h.location)
+}
+
+// HasRedeemed reports whether the customer redeemed a coupon code before
+func (h *RuleHelpers) HasRedeemed(code string) bool {
+	for _, entry := range h.customer.PreviousRedemptions {
+		if strings.EqualFold(entry.CouponCode, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRedeemedSince reports whether the customer redeemed a coupon code in the last days
+func (h *RuleHelpers) HasRedeemedSince(code string, days int64) bool {
+	since := h.Now().AddDate(0, 0, -int(days))
+	for _, entry := range h.customer.PreviousRedemptions {
+		if strings.EqualFold(entry.CouponCode, code) && h.redeemedAfter(entry, since) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedemptionsSince counts the customer's redemptions of any coupon in the last days
+func (h *RuleHelpers) RedemptionsSince(days int64) int64 {
+	since := h.Now().AddDate(0, 0, -int(days))
+	var count int64
+	for _, entry := range h.customer.PreviousRedemptions {
+		if h.redeemedAfter(entry, since) {
+			count++
+		}
+	}
+	return count
+}
+
+// Report whether a redemption happened at or after since. Dates without a time zone
+// are read in the campaign's time zone; unreadable dates never match.
+func (h *RuleHelpers) redeemedAfter(entry RedemptionHistoryEntry, since time.Time) bool {
+	for _, layout := range redemptionDateLayouts {
+		if redeemed, err := time.ParseInLocation(layout, entry.RedemptionDate, h.location); err == nil {
+			return !redeemed.Before(since)
+		}
+	}
+	return false
+}
+
+// NoExpiryDays is what DaysUntilExpiry returns for a coupon without a readable
+// expiration date, so such a coupon never looks expired or about to expire
+const NoExpiryDays = math.MaxInt32
+
+// HasExpiry reports whether the coupon has a readable expiration date
+func (h *RuleHelpers) HasExpiry() bool {
+	_, ok := h.expiry()
+	return ok
+}
+
+// DaysUntilExpiry returns how many days are left before the coupon expires: 0 on its
+// last valid day and negative once expired. A coupon whose expiration date is missing
+// or cannot be read counts as not expiring and gets NoExpiryDays; HasExpiry tells the
+// two apart. Days are counted in the campaign's time zone.
+func (h *RuleHelpers) DaysUntilExpiry() int64 {
+	expiry, ok := h.expiry()
+	if !ok {
+		return NoExpiryDays
+	}
+	now := h.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, h.location)
+	// Round to absorb days that are not 24 hours long around daylight saving changes
+	return int64(math.Round(expiry.Sub(today).Hours() / 24))
+}
+
+// Parse the coupon's expiration date in the campaign's time zone
+func (h *RuleHelpers) expiry() (time.Time, bool) {
+	expiry, err := time.ParseInLocation(dateLayout, h.coupon.ExpirationDate, h.location)
+	return expiry, err == nil
+}
+
+// CartContainsSKU reports whether the order holds the SKU
+func (h *RuleHelpers) CartContainsSKU(skuID int64) bool {
+	return h.order.HasSKU(skuID)
+}
+
+// CartCategoryTotal returns the undiscounted amount of the order lines in a category
+func (h *RuleHelpers) CartCategoryTotal(category string) float64 {
+	return h.order.CategoryTotal(category)
+}
+
+// CartTotal returns the undiscounted amount of the order
+func (h *RuleHelpers) CartTotal() float64 {
+	var cents int64
+	for _, line := range h.order.Lines {
+		cents += toCents(line.Total())
+	}
+	return fromCents(cents)
+}
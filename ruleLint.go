@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+	"github.com/hyperjumptech/grule-rule-engine/builder"
+	"github.com/hyperjumptech/grule-rule-engine/pkg"
+)
+
+var ErrInvalidRuleset = errors.New("invalid ruleset")
+
+// Define a struct to represent a problem found in a ruleset definition. Line and
+// Column are 1-based and 0 when the parser did not report a position; Rule is the
+// rule the problem was found in, if any.
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Rule    string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	var location string
+	if d.Line > 0 {
+		location = fmt.Sprintf("%d:%d: ", d.Line, d.Column)
+	}
+	if d.Rule != "" {
+		location += "rule " + d.Rule + ": "
+	}
+	return location + d.Message
+}
+
+// RulesetError is returned when a ruleset definition does not compile
+type RulesetError struct {
+	Ruleset     string
+	Version     string
+	Diagnostics []Diagnostic
+}
+
+func (e *RulesetError) Error() string {
+	messages := make([]string, len(e.Diagnostics))
+	for i, diagnostic := range e.Diagnostics {
+		messages[i] = diagnostic.String()
+	}
+	return fmt.Sprintf("ruleset %s v%s has %d error(s): %s", e.Ruleset, e.Version, len(e.Diagnostics), strings.Join(messages, "; "))
+}
+
+func (e *RulesetError) Unwrap() error {
+	return ErrInvalidRuleset
+}
+
+var (
+	grlPositionPattern   = regexp.MustCompile(`^grl error on (\d+):(\d+) (.*)$`)
+	ruleHeaderPattern    = regexp.MustCompile(`(?m)^\s*rule\s+([A-Za-z_][A-Za-z0-9_]*)`)
+	duplicateRulePattern = regexp.MustCompile(`^(?:duplicate rule entry (\S+)|rule entry (\S+) already exist)$`)
+)
+
+// LintRuleset parses a ruleset definition and returns every problem found in it,
+// or nothing when the ruleset compiles
+func LintRuleset(ruleset RuleSet) []Diagnostic {
+	_, diagnostics := buildKnowledgeBase(ruleset)
+	return diagnostics
+}
+
+// CompileRuleset checks that a ruleset compiles, failing with a *RulesetError that
+// lists every problem found when it does not
+func CompileRuleset(ruleset RuleSet) error {
+	_, err := compileRuleset(ruleset)
+	return err
+}
+
+// Parse a ruleset definition into a knowledge base, turning parser errors, and
+// parser panics, into diagnostics
+func buildKnowledgeBase(ruleset RuleSet) (knowledgeBase *ast.KnowledgeBase, diagnostics []Diagnostic) {
+	defer func() {
+		if r := recover(); r != nil {
+			knowledgeBase = nil
+			diagnostics = append(diagnostics, Diagnostic{Message: fmt.Sprintf("parser failed: %v", r)})
+		}
+	}()
+
+	if strings.TrimSpace(ruleset.Definition) == "" {
+		return nil, []Diagnostic{{Message: "definition is empty"}}
+	}
+
+	knowledgeLibrary := ast.NewKnowledgeLibrary()
+	ruleBuilder := builder.NewRuleBuilder(knowledgeLibrary)
+	err := ruleBuilder.BuildRuleFromResource(ruleset.Name, ruleset.Version, pkg.NewBytesResource([]byte(ruleset.Definition)))
+	if err != nil {
+		return nil, diagnose(ruleset.Definition, err)
+	}
+
+	knowledgeBase, err = knowledgeLibrary.NewKnowledgeBaseInstance(ruleset.Name, ruleset.Version)
+	if err != nil {
+		return nil, []Diagnostic{{Message: err.Error()}}
+	}
+	if len(knowledgeBase.RuleEntries) == 0 {
+		return nil, []Diagnostic{{Message: "definition holds no rules"}}
+	}
+	return knowledgeBase, nil
+}
+
+// Turn a builder error into diagnostics, locating each one in the definition
+func diagnose(definition string, err error) []Diagnostic {
+	var errs []error
+	var reporter *pkg.GruleErrorReporter
+	if errors.As(err, &reporter) {
+		errs = reporter.Errors
+	} else {
+		errs = []error{err}
+	}
+
+	headers := ruleHeaders(definition)
+	diagnostics := make([]Diagnostic, 0, len(errs))
+	for _, e := range errs {
+		diagnostic := Diagnostic{Message: e.Error()}
+		if match := grlPositionPattern.FindStringSubmatch(e.Error()); match != nil {
+			diagnostic.Line, _ = strconv.Atoi(match[1])
+			column, _ := strconv.Atoi(match[2])
+			diagnostic.Column = column + 1
+			diagnostic.Message = match[3]
+			diagnostic.Rule = headers.ruleAt(diagnostic.Line)
+		} else if match := duplicateRulePattern.FindStringSubmatch(e.Error()); match != nil {
+			diagnostic.Rule = match[1] + match[2]
+			diagnostic.Line = headers.lastLineOf(diagnostic.Rule)
+			if diagnostic.Line > 0 {
+				diagnostic.Column = 1
+			}
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+// Define a struct to represent where a rule starts in a definition
+type ruleHeader struct {
+	Name string
+	Line int
+}
+
+type ruleHeaderList []ruleHeader
+
+// Find the line every rule of a definition starts on
+func ruleHeaders(definition string) ruleHeaderList {
+	var headers ruleHeaderList
+	for _, match := range ruleHeaderPattern.FindAllStringSubmatchIndex(definition, -1) {
+		headers = append(headers, ruleHeader{
+			Name: definition[match[2]:match[3]],
+			Line: strings.Count(definition[:match[2]], "\n") + 1,
+		})
+	}
+	return headers
+}
+
+// Name of the rule a line belongs to
+func (h ruleHeaderList) ruleAt(line int) string {
+	var name string
+	for _, header := range h {
+		if header.Line > line {
+			break
+		}
+		name = header.Name
+	}
+	return name
+}
+
+// Line of the last rule declared with a name, 0 when there is none
+func (h ruleHeaderList) lastLineOf(name string) int {
+	line := 0
+	for _, header := range h {
+		if header.Name == name {
+			line = header.Line
+		}
+	}
+	return line
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLintRuleset(t *testing.T) {
+	valid := `rule Valid "ok" salience 10 {
+    when
+        Coupon.DiscountAmount > 0
+    then
+        Retract("Valid");
+}
+`
+	// The condition of Broken is missing its right operand, so the parser trips over
+	// the then keyword on line 11
+	malformed := valid + `
+rule Broken "missing operand" salience 5 {
+    when
+        Coupon.DiscountAmount >
+    then
+        Retract("Broken");
+}
+`
+	duplicate := valid + `
+rule Valid "again" {
+    when
+        true
+    then
+        Retract("Valid");
+}
+`
+	tests := []struct {
+		name       string
+		definition string
+		want       Diagnostic // the first diagnostic, ignoring its message
+		wantNone   bool
+	}{
+		{"valid", valid, Diagnostic{}, true},
+		{"malformed condition", malformed, Diagnostic{Line: 11, Column: 5, Rule: "Broken"}, false},
+		{"duplicate rule", duplicate, Diagnostic{Line: 8, Column: 1, Rule: "Valid"}, false},
+		{"empty", "  \n", Diagnostic{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ruleset := RuleSet{Name: "LintTest", Version: "1", Definition: test.definition}
+			diagnostics := LintRuleset(ruleset)
+			err := CompileRuleset(ruleset)
+			if test.wantNone {
+				if len(diagnostics) != 0 || err != nil {
+					t.Fatalf("got %v and %v, want no problems", diagnostics, err)
+				}
+				return
+			}
+			if len(diagnostics) == 0 {
+				t.Fatal("got no diagnostics")
+			}
+			got := diagnostics[0]
+			if got.Line != test.want.Line || got.Column != test.want.Column || got.Rule != test.want.Rule {
+				t.Errorf("got %d:%d in rule %q, want %d:%d in rule %q", got.Line, got.Column, got.Rule, test.want.Line, test.want.Column, test.want.Rule)
+			}
+			if got.Message == "" {
+				t.Error("got an empty message")
+			}
+
+			var rulesetErr *RulesetError
+			if !errors.As(err, &rulesetErr) || !errors.Is(err, ErrInvalidRuleset) {
+				t.Fatalf("got %v, want a RulesetError", err)
+			}
+			if len(rulesetErr.Diagnostics) != len(diagnostics) {
+				t.Errorf("RulesetError holds %d diagnostics, LintRuleset found %d", len(rulesetErr.Diagnostics), len(diagnostics))
+			}
+		})
+	}
+}
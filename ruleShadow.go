@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shadowRecentLimit is how many recent disagreements a shadow run keeps in memory
+const shadowRecentLimit = 100
+
+// Define a struct to represent a coupon on which a shadow ruleset version decided
+// differently from the active one
+type ShadowDisagreement struct {
+	Ruleset       string
+	ActiveVersion string
+	ShadowVersion string
+	CouponCode    string
+	Context       string // summary of the customer context
+	Active        ValidationResult
+	Shadow        ValidationResult
+	At            time.Time
+}
+
+// ShadowRecorder persists the disagreements of a shadow run
+type ShadowRecorder interface {
+	RecordDisagreement(disagreement ShadowDisagreement) error
+}
+
+// Define a struct to represent the counts of a shadow run
+type ShadowStats struct {
+	Ruleset       string
+	Version       string
+	Since         time.Time
+	Evaluations   int64
+	Disagreements int64
+	Errors        int64 // shadow evaluations that failed, and disagreements that could not be recorded
+	Recent        []ShadowDisagreement
+}
+
+// Define a struct to represent a shadow version evaluated alongside the active version
+type shadowRun struct {
+	compiled      *compiledRuleset
+	recorder      ShadowRecorder
+	since         time.Time
+	evaluations   int64
+	disagreements int64
+	errors        int64
+	mu            sync.Mutex
+	recent        []ShadowDisagreement
+}
+
+// SetShadow compiles a candidate version and evaluates it in the shadow of the version
+// of the same name on every evaluation that includes that ruleset. The shadow runs on
+// copies of the facts in its own goroutine and never affects decisions; coupons on
+// which it decides differently are counted, kept in memory and, when recorder is not
+// nil, recorded. Setting a shadow replaces the previous one and restarts its counts.
+func (e *RuleEngine) SetShadow(candidate RuleSet, recorder ShadowRecorder) error {
+	compiled, err := compileRuleset(candidate)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	next := e.snapshot.Load().(*ruleSnapshot).copy()
+	next.shadows[candidate.Name] = &shadowRun{compiled: compiled, recorder: recorder, since: time.Now()}
+	e.snapshot.Store(next)
+	return nil
+}
+
+// ShadowRulesetVersion evaluates a saved ruleset version in the shadow of the active
+// version, recording disagreements in the ShadowDisagreements table
+func ShadowRulesetVersion(db *sql.DB, ruleEngine *RuleEngine, name, version string) error {
+	candidate, err := GetRulesetVersion(db, name, version)
+	if err != nil {
+		return err
+	}
+	return ruleEngine.SetShadow(candidate, NewSQLShadowRecorder(db))
+}
+
+// ClearShadow stops shadow evaluation of a ruleset
+func (e *RuleEngine) ClearShadow(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	next := e.snapshot.Load().(*ruleSnapshot).copy()
+	delete(next.shadows, name)
+	e.snapshot.Store(next)
+}
+
+// ShadowStats returns the counts of the shadow run of a ruleset
+func (e *RuleEngine) ShadowStats(name string) (ShadowStats, bool) {
+	run, ok := e.snapshot.Load().(*ruleSnapshot).shadows[name]
+	if !ok {
+		return ShadowStats{}, false
+	}
+	run.mu.Lock()
+	recent := append([]ShadowDisagreement(nil), run.recent...)
+	run.mu.Unlock()
+	return ShadowStats{
+		Ruleset:       name,
+		Version:       run.compiled.Version,
+		Since:         run.since,
+		Evaluations:   atomic.LoadInt64(&run.evaluations),
+		Disagreements: atomic.LoadInt64(&run.disagreements),
+		Errors:        atomic.LoadInt64(&run.errors),
+		Recent:        recent,
+	}, true
+}
+
+// WaitForShadows blocks until the shadow evaluations in flight have finished
+func (e *RuleEngine) WaitForShadows() {
+	e.shadows.Wait()
+}
+
+// Start evaluating the shadow versions of the attached rulesets on copies of the facts
+// and return the function that hands them the active outcome to compare with
+func (e *RuleEngine) startShadows(attached []AttachedRuleset, compiled []*compiledRuleset, facts RuleFacts) func(CouponEvaluation) {
+	shadows := e.snapshot.Load().(*ruleSnapshot).shadows
+	if len(shadows) == 0 {
+		return func(CouponEvaluation) {}
+	}
+
+	var outcomes []chan CouponEvaluation
+	for i, a := range attached {
+		run, ok := shadows[a.Name]
+		if !ok || run.compiled.Version == compiled[i].Version && run.compiled.Definition == compiled[i].Definition {
+			continue
+		}
+
+		substituted := append([]*compiledRuleset(nil), compiled...)
+		substituted[i] = run.compiled
+		stages := attachmentStages(attached, substituted)
+
+		coupon, customer, change, options, order := *facts.Coupon, *facts.CustomerContext, *facts.ChangeContext, *facts.OptionsContext, *facts.OrderContext
+		shadowFacts := facts
+		shadowFacts.Coupon, shadowFacts.CustomerContext, shadowFacts.ChangeContext, shadowFacts.OptionsContext, shadowFacts.OrderContext = &coupon, &customer, &change, &options, &order
+		summary := summarizeCustomer(customer)
+		activeVersion := compiled[i].Version
+
+		outcome := make(chan CouponEvaluation, 1)
+		outcomes = append(outcomes, outcome)
+		e.shadows.Add(1)
+		go func() {
+			defer e.shadows.Done()
+			shadow := evaluateStages(stages, shadowFacts)
+			run.compare(activeVersion, summary, <-outcome, shadow)
+		}()
+	}
+
+	return func(active CouponEvaluation) {
+		for _, outcome := range outcomes {
+			outcome <- active
+		}
+	}
+}
+
+// Count a shadow evaluation and keep it when it disagrees with the active outcome
+func (r *shadowRun) compare(activeVersion, summary string, active, shadow CouponEvaluation) {
+	atomic.AddInt64(&r.evaluations, 1)
+	if shadow.Err != nil {
+		atomic.AddInt64(&r.errors, 1)
+	}
+	if active.Valid == shadow.Valid && active.Reason == shadow.Reason {
+		return
+	}
+	atomic.AddInt64(&r.disagreements, 1)
+
+	disagreement := ShadowDisagreement{
+		Ruleset:       r.compiled.Name,
+		ActiveVersion: activeVersion,
+		ShadowVersion: r.compiled.Version,
+		CouponCode:    active.CouponCode,
+		Context:       summary,
+		Active:        active.ValidationResult,
+		Shadow:        shadow.ValidationResult,
+		At:            time.Now(),
+	}
+
+	r.mu.Lock()
+	if len(r.recent) == shadowRecentLimit {
+		r.recent = r.recent[1:]
+	}
+	r.recent = append(r.recent, disagreement)
+	r.mu.Unlock()
+
+	if r.recorder != nil {
+		if err := r.recorder.RecordDisagreement(disagreement); err != nil {
+			atomic.AddInt64(&r.errors, 1)
+		}
+	}
+}
+
+// Summarize a customer context for disagreement reports
+func summarizeCustomer(customer CustomerContext) string {
+	return fmt.Sprintf("user=%d subscriber=%t new=%t redemptions=%d coupon_uses=%d",
+		customer.UserID, customer.IsSubscriber, customer.IsNewCustomer, len(customer.PreviousRedemptions), customer.CouponUsageCount)
+}
+
+// SQLShadowRecorder records shadow disagreements in the ShadowDisagreements table
+type SQLShadowRecorder struct {
+	db *sql.DB
+}
+
+// Create a shadow recorder backed by the ShadowDisagreements table
+func NewSQLShadowRecorder(db *sql.DB) *SQLShadowRecorder {
+	return &SQLShadowRecorder{db: db}
+}
+
+func (r *SQLShadowRecorder) RecordDisagreement(d ShadowDisagreement) error {
+	_, err := r.db.Exec("INSERT INTO ShadowDisagreements (ruleset, active_version, shadow_version, coupon_code, context_summary, active_valid, active_reason, active_rule, shadow_valid, shadow_reason, shadow_rule, created_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.Ruleset, d.ActiveVersion, d.ShadowVersion, d.CouponCode, d.Context, d.Active.Valid, d.Active.Reason, d.Active.Rule, d.Shadow.Valid, d.Shadow.Reason, d.Shadow.Rule, d.At.UTC())
+	return err
+}
+
+// Count the recorded disagreements of a shadow version
+func CountShadowDisagreements(db *sql.DB, ruleset, shadowVersion string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM ShadowDisagreements WHERE ruleset = ? AND shadow_version = ?", ruleset, shadowVersion).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Attachment modes of a ruleset: every ruleset in all mode must leave the coupon valid,
+// while of the rulesets in any mode at the same scope one doing so is enough
+const (
+	RulesetModeAll = "all"
+	RulesetModeAny = "any"
+)
+
+// Scopes a ruleset is attached at
+const (
+	RulesetScopeCampaign = "campaign"
+	RulesetScopeCoupon   = "coupon"
+)
+
+var (
+	ErrInvalidRulesetMode     = errors.New("ruleset mode must be all or any")
+	ErrRulesetNotFound        = errors.New("ruleset not found")
+	ErrRulesetVersionExists   = errors.New("ruleset version already exists")
+	ErrRulesetVersionNotFound = errors.New("ruleset version not found")
+	ErrNoPreviousVersion      = errors.New("ruleset has no previous version to roll back to")
+)
+
+// Define a struct to represent a stored version of a ruleset
+type RulesetVersion struct {
+	ID        int
+	RulesetID int
+	RuleSet
+	CreatedAt string
+	Active    bool
+}
+
+// SaveRuleset stores a new, immutable version of a ruleset, creating the ruleset on
+// its first save, and returns the version ID. The definition is compiled first and a
+// ruleset that does not compile is rejected with a *RulesetError. An empty Version is
+// numbered one past the highest numeric version already saved, ignoring named versions
+// such as 2.1 or beta. Saving does not activate the version.
+func SaveRuleset(db *sql.DB, ruleset RuleSet) (int, error) {
+	if err := CompileRuleset(ruleset); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT IGNORE INTO Rulesets (name) VALUES (?)", ruleset.Name)
+	if err != nil {
+		return 0, err
+	}
+	var rulesetID, highest int
+	err = tx.QueryRow("SELECT id FROM Rulesets WHERE name = ? FOR UPDATE", ruleset.Name).Scan(&rulesetID)
+	if err != nil {
+		return 0, err
+	}
+
+	if ruleset.Version == "" {
+		err = tx.QueryRow("SELECT COALESCE(MAX(CAST(version AS UNSIGNED)), 0) FROM RulesetVersions WHERE ruleset_id = ? AND version REGEXP '^[0-9]+$'",
+			rulesetID).Scan(&highest)
+		if err != nil {
+			return 0, err
+		}
+		ruleset.Version = strconv.Itoa(highest + 1)
+	}
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM RulesetVersions WHERE ruleset_id = ? AND version = ?)", rulesetID, ruleset.Version).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, fmt.Errorf("%w: %s v%s", ErrRulesetVersionExists, ruleset.Name, ruleset.Version)
+	}
+
+	result, err := tx.Exec("INSERT INTO RulesetVersions (ruleset_id, version, definition, created_at) VALUES (?, ?, ?, NOW())",
+		rulesetID, ruleset.Version, ruleset.Definition)
+	if err != nil {
+		return 0, err
+	}
+	versionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(versionID), nil
+}
+
+// PromoteRulesetVersion makes a saved version the active version of its ruleset. The
+// version it replaces is remembered so the promotion can be rolled back.
+func PromoteRulesetVersion(db *sql.DB, name, version string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rulesetID, activeID, _, err := lockRuleset(tx, name)
+	if err != nil {
+		return err
+	}
+
+	var versionID int
+	err = tx.QueryRow("SELECT id FROM RulesetVersions WHERE ruleset_id = ? AND version = ?", rulesetID, version).Scan(&versionID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s v%s", ErrRulesetVersionNotFound, name, version)
+	}
+	if err != nil {
+		return err
+	}
+	if activeID.Valid && int(activeID.Int64) == versionID {
+		return nil
+	}
+
+	_, err = tx.Exec("UPDATE Rulesets SET previous_version_id = active_version_id, active_version_id = ? WHERE id = ?", versionID, rulesetID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RollbackRuleset reactivates the version that was active before the last promotion.
+// Rollback goes back one step only: rolling back twice in a row fails with
+// ErrNoPreviousVersion.
+func RollbackRuleset(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rulesetID, _, previousID, err := lockRuleset(tx, name)
+	if err != nil {
+		return err
+	}
+	if !previousID.Valid {
+		return fmt.Errorf("%w: %s", ErrNoPreviousVersion, name)
+	}
+
+	_, err = tx.Exec("UPDATE Rulesets SET active_version_id = previous_version_id, previous_version_id = NULL WHERE id = ?", rulesetID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Lock a ruleset row for the rest of the transaction and return its version pointers
+func lockRuleset(tx *sql.Tx, name string) (int, sql.NullInt64, sql.NullInt64, error) {
+	var rulesetID int
+	var activeID, previousID sql.NullInt64
+	err := tx.QueryRow("SELECT id, active_version_id, previous_version_id FROM Rulesets WHERE name = ? FOR UPDATE", name).
+		Scan(&rulesetID, &activeID, &previousID)
+	if err == sql.ErrNoRows {
+		return 0, activeID, previousID, fmt.Errorf("%w: %s", ErrRulesetNotFound, name)
+	}
+	return rulesetID, activeID, previousID, err
+}
+
+// Retrieve the active version of a ruleset
+func GetActiveRuleset(db *sql.DB, name string) (RuleSet, error) {
+	ruleset := RuleSet{Name: name}
+	err := db.QueryRow("SELECT v.version, v.definition FROM Rulesets r JOIN RulesetVersions v ON v.id = r.active_version_id WHERE r.name = ?", name).
+		Scan(&ruleset.Version, &ruleset.Definition)
+	if err == sql.ErrNoRows {
+		return ruleset, fmt.Errorf("%w: %s has no active version", ErrRulesetNotFound, name)
+	}
+	return ruleset, err
+}
+
+// Retrieve a saved version of a ruleset
+func GetRulesetVersion(db *sql.DB, name, version string) (RuleSet, error) {
+	ruleset := RuleSet{Name: name, Version: version}
+	err := db.QueryRow("SELECT v.definition FROM Rulesets r JOIN RulesetVersions v ON v.ruleset_id = r.id WHERE r.name = ? AND v.version = ?", name, version).
+		Scan(&ruleset.Definition)
+	if err == sql.ErrNoRows {
+		return ruleset, fmt.Errorf("%w: %s v%s", ErrRulesetVersionNotFound, name, version)
+	}
+	return ruleset, err
+}
+
+// Retrieve every saved version of a ruleset, oldest first
+func GetRulesetVersions(db *sql.DB, name string) ([]RulesetVersion, error) {
+	rows, err := db.Query("SELECT v.id, v.ruleset_id, v.version, v.definition, v.created_at, v.id <=> r.active_version_id FROM Rulesets r "+
+		"JOIN RulesetVersions v ON v.ruleset_id = r.id WHERE r.name = ? ORDER BY v.id", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []RulesetVersion
+	for rows.Next() {
+		version := RulesetVersion{RuleSet: RuleSet{Name: name}}
+		if err := rows.Scan(&version.ID, &version.RulesetID, &version.Version, &version.Definition, &version.CreatedAt, &version.Active); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// LoadActiveRulesets compiles the active versions of the rulesets attached to any
+// campaign or coupon and swaps them into the rule engine in one step. A ruleset that
+// does not compile fails the load and leaves the engine unchanged.
+func LoadActiveRulesets(db *sql.DB, ruleEngine *RuleEngine) error {
+	rows, err := db.Query("SELECT r.name, v.version, v.definition FROM Rulesets r JOIN RulesetVersions v ON v.id = r.active_version_id " +
+		"WHERE r.id IN (SELECT ruleset_id FROM Campaign_Rulesets UNION SELECT ruleset_id FROM Coupon_Rulesets) ORDER BY r.id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var rulesets []RuleSet
+	for rows.Next() {
+		var ruleset RuleSet
+		if err := rows.Scan(&ruleset.Name, &ruleset.Version, &ruleset.Definition); err != nil {
+			return err
+		}
+		rulesets = append(rulesets, ruleset)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return ruleEngine.Swap(rulesets...)
+}
+
+// Define a struct to represent a ruleset attached to a campaign or coupon
+type AttachedRuleset struct {
+	RuleSet
+	Scope string
+	Mode  string
+}
+
+// Attach a ruleset to a campaign. Rulesets of a scope are evaluated by position.
+func AttachRulesetToCampaign(db *sql.DB, campaignID int, name, mode string, position int) error {
+	return attachRuleset(db, "Campaign_Rulesets", "campaign_id", campaignID, name, mode, position)
+}
+
+// Attach a ruleset to a coupon. Rulesets of a scope are evaluated by position.
+func AttachRulesetToCoupon(db *sql.DB, couponID int, name, mode string, position int) error {
+	return attachRuleset(db, "Coupon_Rulesets", "coupon_id", couponID, name, mode, position)
+}
+
+// Insert or update the attachment of a ruleset in one of the attachment tables
+func attachRuleset(db *sql.DB, table, ownerColumn string, ownerID int, name, mode string, position int) error {
+	if mode != RulesetModeAll && mode != RulesetModeAny {
+		return fmt.Errorf("%w: %q", ErrInvalidRulesetMode, mode)
+	}
+
+	var rulesetID int
+	err := db.QueryRow("SELECT id FROM Rulesets WHERE name = ?", name).Scan(&rulesetID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrRulesetNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO "+table+" ("+ownerColumn+", ruleset_id, mode, position) VALUES (?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE mode = VALUES(mode), position = VALUES(position)",
+		ownerID, rulesetID, mode, position)
+	return err
+}
+
+// Detach a ruleset from a campaign
+func DetachRulesetFromCampaign(db *sql.DB, campaignID int, name string) error {
+	_, err := db.Exec("DELETE cr FROM Campaign_Rulesets cr JOIN Rulesets r ON r.id = cr.ruleset_id WHERE cr.campaign_id = ? AND r.name = ?", campaignID, name)
+	return err
+}
+
+// Detach a ruleset from a coupon
+func DetachRulesetFromCoupon(db *sql.DB, couponID int, name string) error {
+	_, err := db.Exec("DELETE cr FROM Coupon_Rulesets cr JOIN Rulesets r ON r.id = cr.ruleset_id WHERE cr.coupon_id = ? AND r.name = ?", couponID, name)
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRulesetFixtures(t *testing.T) {
+	CheckRulesetFixtures(t, "testdata/rulesets/*.json", "testdata/rulesets/*.yaml")
+}
+
+func TestSaveRulesetNumbersAfterHighestVersion(t *testing.T) {
+	db := openTestDB(t)
+	definition := `rule Always "always" { when true then Retract("Always"); }`
+	name := fmt.Sprintf("VersionTest%d", time.Now().UnixNano())
+
+	for _, version := range []string{"1", "3", "beta", "10.5"} {
+		if _, err := SaveRuleset(db, RuleSet{Name: name, Version: version, Definition: definition}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SaveRuleset(db, RuleSet{Name: name, Definition: definition}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetRulesetVersion(db, name, "4"); err != nil {
+		t.Errorf("the unnumbered save was not stored as version 4: %v", err)
+	}
+}
@@ -4,7 +4,20 @@ CREATE TABLE Campaigns (
     campaign_name VARCHAR(255) NOT NULL,
     start_date DATE NOT NULL,
     end_date DATE NOT NULL,
-    is_active BOOLEAN NOT NULL
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    is_active BOOLEAN NOT NULL,
+    budget DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    budget_policy VARCHAR(20) NOT NULL DEFAULT 'reject'
+);
+
+-- Create the Campaign_Windows table to restrict campaigns to recurring times of day
+CREATE TABLE Campaign_Windows (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    campaign_id INT NOT NULL,
+    weekdays VARCHAR(32) NOT NULL,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    FOREIGN KEY (campaign_id) REFERENCES Campaigns(id)
 );
 
 -- Create the Coupons table
@@ -18,13 +31,44 @@ CREATE TABLE Coupons (
     expiration_date DATE NOT NULL,
     is_single_use BOOLEAN NOT NULL,
     usage_limit INT NOT NULL,
+    per_user_limit INT NOT NULL DEFAULT 0,
+    per_user_window_days INT NOT NULL DEFAULT 0,
     is_active BOOLEAN NOT NULL,
+    reversal_policy VARCHAR(20) NOT NULL DEFAULT 'restore',
     campaign_id INT NOT NULL,
     FOREIGN KEY (campaign_id) REFERENCES Campaigns(id),
     INDEX idx_code (code),
     INDEX idx_expiration_date (expiration_date)
 );
 
+-- Create the Campaign_Restrictions table to limit where a campaign's coupons are redeemed
+CREATE TABLE Campaign_Restrictions (
+    campaign_id INT NOT NULL,
+    restriction_type VARCHAR(20) NOT NULL,
+    value VARCHAR(64) NOT NULL,
+    PRIMARY KEY (campaign_id, restriction_type, value),
+    FOREIGN KEY (campaign_id) REFERENCES Campaigns(id)
+);
+
+-- Create the Coupon_Restrictions table to limit where a coupon is redeemed
+CREATE TABLE Coupon_Restrictions (
+    coupon_id INT NOT NULL,
+    restriction_type VARCHAR(20) NOT NULL,
+    value VARCHAR(64) NOT NULL,
+    PRIMARY KEY (coupon_id, restriction_type, value),
+    FOREIGN KEY (coupon_id) REFERENCES Coupons(id)
+);
+
+-- Create the Coupon_Assignments table to restrict coupons to allowlisted users or block denylisted ones
+CREATE TABLE Coupon_Assignments (
+    coupon_id INT NOT NULL,
+    user_id INT NOT NULL,
+    list_type VARCHAR(10) NOT NULL,
+    PRIMARY KEY (coupon_id, user_id),
+    FOREIGN KEY (coupon_id) REFERENCES Coupons(id),
+    INDEX idx_user_list (user_id, list_type)
+);
+
 -- Create the SKU table
 CREATE TABLE SKU (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -50,8 +94,91 @@ CREATE TABLE CouponUsage (
     order_id INT NOT NULL,
     usage_date DATETIME NOT NULL,
     is_used BOOLEAN NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'redeemed',
+    expires_at DATETIME NULL,
+    requested_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    discount_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    reversed_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    idempotency_key VARCHAR(100) NULL,
+    channel VARCHAR(20) NOT NULL DEFAULT '',
+    store_id INT NOT NULL DEFAULT 0,
+    country CHAR(2) NOT NULL DEFAULT '',
+    region VARCHAR(6) NOT NULL DEFAULT '',
+    device_fingerprint VARCHAR(128) NOT NULL DEFAULT '',
+    payment_fingerprint VARCHAR(128) NOT NULL DEFAULT '',
+    fraud_score INT NOT NULL DEFAULT 0,
+    fraud_decision VARCHAR(10) NOT NULL DEFAULT 'allow',
+    fraud_reasons VARCHAR(255) NOT NULL DEFAULT '',
     FOREIGN KEY (coupon_id) REFERENCES Coupons(id),
-    INDEX idx_usage_date (usage_date)
+    UNIQUE INDEX idx_idempotency_key (idempotency_key),
+    INDEX idx_coupon_order (coupon_id, order_id),
+    INDEX idx_coupon_user (coupon_id, user_id, usage_date),
+    INDEX idx_device_fingerprint (device_fingerprint, usage_date),
+    INDEX idx_payment_fingerprint (payment_fingerprint, usage_date),
+    INDEX idx_fraud_decision (fraud_decision),
+    INDEX idx_usage_date (usage_date),
+    INDEX idx_status_expires_at (status, expires_at)
+);
+
+-- Create the CouponUsageAllocations table to split an order-level discount across order lines
+CREATE TABLE CouponUsageAllocations (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    usage_id INT NOT NULL,
+    line_number INT NOT NULL,
+    sku_id INT NOT NULL,
+    quantity INT NOT NULL,
+    line_amount DECIMAL(10, 2) NOT NULL,
+    discount_amount DECIMAL(10, 2) NOT NULL,
+    returned_quantity INT NOT NULL DEFAULT 0,
+    FOREIGN KEY (usage_id) REFERENCES CouponUsage(id),
+    UNIQUE INDEX idx_usage_line (usage_id, line_number)
+);
+
+-- Create the CouponUsageReversals table to audit cancelled and refunded redemptions
+CREATE TABLE CouponUsageReversals (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    usage_id INT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    is_full BOOLEAN NOT NULL,
+    capacity_restored BOOLEAN NOT NULL,
+    reversed_at DATETIME NOT NULL,
+    FOREIGN KEY (usage_id) REFERENCES CouponUsage(id)
+);
+
+-- Create the StoredValueBalances table to hold the balance of stored-value coupons
+CREATE TABLE StoredValueBalances (
+    coupon_id INT PRIMARY KEY,
+    initial_balance DECIMAL(10, 2) NOT NULL,
+    balance DECIMAL(10, 2) NOT NULL,
+    FOREIGN KEY (coupon_id) REFERENCES Coupons(id)
+);
+
+-- Create the StoredValueLedger table to record every debit and credit of a stored-value coupon
+CREATE TABLE StoredValueLedger (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    coupon_id INT NOT NULL,
+    order_id INT NOT NULL,
+    entry_type VARCHAR(10) NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    balance_after DECIMAL(10, 2) NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (coupon_id) REFERENCES StoredValueBalances(coupon_id),
+    INDEX idx_coupon_order (coupon_id, order_id)
+);
+
+-- Create the RateLimitAttempts table to share coupon validation attempts between instances
+CREATE TABLE RateLimitAttempts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    limit_key VARCHAR(255) NOT NULL,
+    attempted_at DATETIME NOT NULL,
+    INDEX idx_key_attempted_at (limit_key, attempted_at)
+);
+
+-- Create the RateLimitLockouts table to share validation lockouts between instances
+CREATE TABLE RateLimitLockouts (
+    limit_key VARCHAR(255) PRIMARY KEY,
+    locked_until DATETIME NOT NULL
 );
 
 -- Create the Referral table
@@ -70,13 +197,32 @@ CREATE TABLE Referral (
 CREATE TABLE Rulesets (
     id INT AUTO_INCREMENT PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    definition TEXT NOT NULL
+    active_version_id INT,
+    previous_version_id INT,
+    UNIQUE INDEX idx_name (name)
+);
+
+-- Create the RulesetVersions table to store the immutable versions of each ruleset
+CREATE TABLE RulesetVersions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    ruleset_id INT NOT NULL,
+    version VARCHAR(64) NOT NULL,
+    definition TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (ruleset_id) REFERENCES Rulesets(id),
+    UNIQUE INDEX idx_ruleset_version (ruleset_id, version)
 );
 
+ALTER TABLE Rulesets
+    ADD FOREIGN KEY (active_version_id) REFERENCES RulesetVersions(id),
+    ADD FOREIGN KEY (previous_version_id) REFERENCES RulesetVersions(id);
+
 -- Create the Campaign_Rulesets table to associate campaigns with rulesets
 CREATE TABLE Campaign_Rulesets (
     campaign_id INT NOT NULL,
     ruleset_id INT NOT NULL,
+    mode VARCHAR(3) NOT NULL DEFAULT 'all',
+    position INT NOT NULL DEFAULT 0,
     PRIMARY KEY (campaign_id, ruleset_id),
     FOREIGN KEY (campaign_id) REFERENCES Campaigns(id),
     FOREIGN KEY (ruleset_id) REFERENCES Rulesets(id)
@@ -86,7 +232,27 @@ CREATE TABLE Campaign_Rulesets (
 CREATE TABLE Coupon_Rulesets (
     coupon_id INT NOT NULL,
     ruleset_id INT NOT NULL,
+    mode VARCHAR(3) NOT NULL DEFAULT 'all',
+    position INT NOT NULL DEFAULT 0,
     PRIMARY KEY (coupon_id, ruleset_id),
     FOREIGN KEY (coupon_id) REFERENCES Coupons(id),
     FOREIGN KEY (ruleset_id) REFERENCES Rulesets(id)
-);
\ No newline at end of file
+);
+
+-- Create the ShadowDisagreements table to record coupons on which a shadow ruleset version decided differently from the active one
+CREATE TABLE ShadowDisagreements (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    ruleset VARCHAR(255) NOT NULL,
+    active_version VARCHAR(64) NOT NULL,
+    shadow_version VARCHAR(64) NOT NULL,
+    coupon_code VARCHAR(255) NOT NULL,
+    context_summary VARCHAR(255) NOT NULL,
+    active_valid BOOLEAN NOT NULL,
+    active_reason VARCHAR(32) NOT NULL,
+    active_rule VARCHAR(255) NOT NULL,
+    shadow_valid BOOLEAN NOT NULL,
+    shadow_reason VARCHAR(32) NOT NULL,
+    shadow_rule VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_ruleset_shadow_version (ruleset, shadow_version)
+);
@@ -3,6 +3,7 @@ package main
 /*
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 
@@ -101,7 +102,15 @@ func recordCouponUsageHandler(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		coupons.RecordCouponUsage(db, usageData.CouponID, usageData.UserID, usageData.OrderID)
+		_, err := coupons.Redeem(db, coupons.RedemptionRequest{CouponID: usageData.CouponID, UserID: usageData.UserID, OrderID: usageData.OrderID})
+		if errors.Is(err, coupons.ErrUsageLimitReached) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Coupon usage recorded successfully"})
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DiscountTypeStoredValue marks a coupon that carries a spendable balance, such as a
+// gift card, instead of a per-order discount
+const DiscountTypeStoredValue = "stored_value"
+
+// Ledger entry types for stored-value coupons
+const (
+	LedgerDebit  = "debit"
+	LedgerCredit = "credit"
+)
+
+var (
+	ErrNotStoredValue       = errors.New("coupon is not a stored-value coupon")
+	ErrStoredValueExhausted = errors.New("stored-value balance is exhausted")
+	ErrCreditExceedsDebits  = errors.New("credit exceeds the amount debited for the order")
+	ErrInvalidLedgerAmount  = errors.New("ledger amount must be positive")
+	ErrStoredValueInactive  = errors.New("stored-value coupon is not active")
+)
+
+// Define a struct to represent a stored-value balance
+type StoredValueBalance struct {
+	CouponID       int
+	InitialBalance float64
+	Balance        float64
+}
+
+// Define a struct to represent a stored-value ledger entry
+type StoredValueEntry struct {
+	ID           int
+	CouponID     int
+	OrderID      int
+	EntryType    string
+	Amount       float64
+	BalanceAfter float64
+	CreatedAt    string
+}
+
+// IsStoredValue reports whether the coupon carries a balance
+func (c *Coupon) IsStoredValue() bool {
+	return c.DiscountType == DiscountTypeStoredValue
+}
+
+// Issue a stored-value coupon with an initial balance and return the coupon ID
+func IssueStoredValueCoupon(db *sql.DB, coupon Coupon, amount float64) (int, error) {
+	if amount <= 0 {
+		return 0, ErrInvalidLedgerAmount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO Coupons (code, description, discount_type, discount_value, minimum_purchase, expiration_date, is_single_use, usage_limit, is_active, campaign_id) VALUES (?, ?, ?, ?, ?, ?, false, 0, ?, ?)",
+		coupon.Code, coupon.Description, DiscountTypeStoredValue, amount, coupon.MinimumPurchase, coupon.ExpirationDate, coupon.IsActive, coupon.CampaignID)
+	if err != nil {
+		return 0, err
+	}
+	couponID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("INSERT INTO StoredValueBalances (coupon_id, initial_balance, balance) VALUES (?, ?, ?)",
+		couponID, amount, amount)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(couponID), nil
+}
+
+// Retrieve the current balance of a stored-value coupon
+func GetStoredValueBalance(db *sql.DB, couponID int) (StoredValueBalance, error) {
+	balance := StoredValueBalance{CouponID: couponID}
+	err := db.QueryRow("SELECT initial_balance, balance FROM StoredValueBalances WHERE coupon_id = ?", couponID).
+		Scan(&balance.InitialBalance, &balance.Balance)
+	if err == sql.ErrNoRows {
+		return balance, ErrNotStoredValue
+	}
+	return balance, err
+}
+
+// DebitStoredValue spends up to amount from the balance of a stored-value coupon for
+// an order. When the balance is smaller than amount the remaining balance is spent;
+// the returned entry holds the amount actually debited.
+func DebitStoredValue(db *sql.DB, couponID, orderID int, amount float64) (StoredValueEntry, error) {
+	if amount <= 0 {
+		return StoredValueEntry{}, ErrInvalidLedgerAmount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	balance, isActive, err := lockStoredValueBalance(tx, couponID)
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+	if !isActive {
+		return StoredValueEntry{}, ErrStoredValueInactive
+	}
+
+	balanceCents := toCents(balance.Balance)
+	if balanceCents <= 0 {
+		return StoredValueEntry{}, ErrStoredValueExhausted
+	}
+	debitCents := toCents(amount)
+	if debitCents > balanceCents {
+		debitCents = balanceCents
+	}
+
+	entry, err := insertLedgerEntry(tx, couponID, orderID, LedgerDebit, debitCents, balanceCents-debitCents)
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StoredValueEntry{}, err
+	}
+	return entry, nil
+}
+
+// CreditStoredValue returns amount to the balance of a stored-value coupon, e.g. when
+// an order paid with it is refunded. The credit may not exceed what the order spent.
+func CreditStoredValue(db *sql.DB, couponID, orderID int, amount float64) (StoredValueEntry, error) {
+	if amount <= 0 {
+		return StoredValueEntry{}, ErrInvalidLedgerAmount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	balance, _, err := lockStoredValueBalance(tx, couponID)
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+
+	var netDebited float64
+	err = tx.QueryRow("SELECT COALESCE(SUM(CASE WHEN entry_type = ? THEN amount ELSE -amount END), 0) FROM StoredValueLedger WHERE coupon_id = ? AND order_id = ?",
+		LedgerDebit, couponID, orderID).Scan(&netDebited)
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+	creditCents := toCents(amount)
+	if creditCents > toCents(netDebited) {
+		return StoredValueEntry{}, fmt.Errorf("%w: %.2f > %.2f", ErrCreditExceedsDebits, amount, netDebited)
+	}
+
+	entry, err := insertLedgerEntry(tx, couponID, orderID, LedgerCredit, creditCents, toCents(balance.Balance)+creditCents)
+	if err != nil {
+		return StoredValueEntry{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StoredValueEntry{}, err
+	}
+	return entry, nil
+}
+
+// Retrieve the ledger of a stored-value coupon, oldest entry first
+func GetStoredValueLedger(db *sql.DB, couponID int) ([]StoredValueEntry, error) {
+	rows, err := db.Query("SELECT id, coupon_id, order_id, entry_type, amount, balance_after, created_at FROM StoredValueLedger WHERE coupon_id = ? ORDER BY id", couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []StoredValueEntry
+	for rows.Next() {
+		var entry StoredValueEntry
+		if err := rows.Scan(&entry.ID, &entry.CouponID, &entry.OrderID, &entry.EntryType, &entry.Amount, &entry.BalanceAfter, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Lock the balance row of a stored-value coupon for the rest of the transaction
+func lockStoredValueBalance(tx *sql.Tx, couponID int) (StoredValueBalance, bool, error) {
+	balance := StoredValueBalance{CouponID: couponID}
+	var isActive bool
+	err := tx.QueryRow("SELECT b.initial_balance, b.balance, c.is_active FROM StoredValueBalances b JOIN Coupons c ON c.id = b.coupon_id WHERE b.coupon_id = ? FOR UPDATE", couponID).
+		Scan(&balance.InitialBalance, &balance.Balance, &isActive)
+	if err == sql.ErrNoRows {
+		return balance, false, ErrNotStoredValue
+	}
+	return balance, isActive, err
+}
+
+// Write a ledger entry and move the balance to balanceAfterCents
+func insertLedgerEntry(tx *sql.Tx, couponID, orderID int, entryType string, amountCents, balanceAfterCents int64) (StoredValueEntry, error) {
+	entry := StoredValueEntry{
+		CouponID:     couponID,
+		OrderID:      orderID,
+		EntryType:    entryType,
+		Amount:       fromCents(amountCents),
+		BalanceAfter: fromCents(balanceAfterCents),
+	}
+
+	_, err := tx.Exec("UPDATE StoredValueBalances SET balance = ? WHERE coupon_id = ?", entry.BalanceAfter, couponID)
+	if err != nil {
+		return entry, err
+	}
+
+	result, err := tx.Exec("INSERT INTO StoredValueLedger (coupon_id, order_id, entry_type, amount, balance_after, created_at) VALUES (?, ?, ?, ?, ?, NOW())",
+		couponID, orderID, entryType, entry.Amount, entry.BalanceAfter)
+	if err != nil {
+		return entry, err
+	}
+	entryID, err := result.LastInsertId()
+	if err != nil {
+		return entry, err
+	}
+	entry.ID = int(entryID)
+	return entry, nil
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hyperjumptech/grule-rule-engine/ast"
+)
+
+// Layout of the DATE columns used for coupon and campaign dates
+const dateLayout = "2006-01-02"
+
+// ReasonCode is a machine-readable explanation of why a coupon was rejected
+type ReasonCode string
+
+const (
+	ReasonNone               ReasonCode = ""
+	ReasonExpired            ReasonCode = "EXPIRED"
+	ReasonInactive           ReasonCode = "INACTIVE"
+	ReasonCampaignEnded      ReasonCode = "CAMPAIGN_ENDED"
+	ReasonCampaignNotStarted ReasonCode = "CAMPAIGN_NOT_STARTED"
+	ReasonCampaignInactive   ReasonCode = "CAMPAIGN_INACTIVE"
+	ReasonOutsideWindow      ReasonCode = "OUTSIDE_VALIDITY_WINDOW"
+	ReasonBelowMinimum       ReasonCode = "BELOW_MINIMUM"
+	ReasonUsageExhausted     ReasonCode = "USAGE_EXHAUSTED"
+	ReasonUserLimitReached   ReasonCode = "USER_LIMIT_REACHED"
+	ReasonBudgetExhausted    ReasonCode = "BUDGET_EXHAUSTED"
+	ReasonNotEligibleSKU     ReasonCode = "NOT_ELIGIBLE_SKU"
+	ReasonChannelNotAllowed  ReasonCode = "CHANNEL_NOT_ALLOWED"
+	ReasonStoreNotAllowed    ReasonCode = "STORE_NOT_ALLOWED"
+	ReasonRegionNotAllowed   ReasonCode = "REGION_NOT_ALLOWED"
+	ReasonNotAssigned        ReasonCode = "NOT_ASSIGNED"
+	ReasonUserDenied         ReasonCode = "USER_DENIED"
+	ReasonRuleRejected       ReasonCode = "RULE_REJECTED"
+	ReasonRuleError          ReasonCode = "RULE_ERROR"
+	ReasonCouponNotFound     ReasonCode = "COUPON_NOT_FOUND"
+	ReasonRateLimited        ReasonCode = "RATE_LIMITED"
+)
+
+// Default human-readable messages for each reason code
+var reasonMessages = map[ReasonCode]string{
+	ReasonExpired:            "This coupon has expired.",
+	ReasonInactive:           "This coupon is no longer active.",
+	ReasonCampaignEnded:      "The promotion for this coupon has ended.",
+	ReasonCampaignNotStarted: "The promotion for this coupon has not started yet.",
+	ReasonCampaignInactive:   "The promotion for this coupon is not running.",
+	ReasonOutsideWindow:      "This coupon cannot be used at this time of day.",
+	ReasonBelowMinimum:       "Your order does not reach the minimum purchase for this coupon.",
+	ReasonUsageExhausted:     "This coupon has reached its usage limit.",
+	ReasonUserLimitReached:   "You have already used this coupon as many times as allowed.",
+	ReasonBudgetExhausted:    "The promotion for this coupon has run out.",
+	ReasonNotEligibleSKU:     "This coupon does not apply to the items in your order.",
+	ReasonChannelNotAllowed:  "This coupon cannot be used through this sales channel.",
+	ReasonStoreNotAllowed:    "This coupon cannot be used at this store.",
+	ReasonRegionNotAllowed:   "This coupon cannot be used in your region.",
+	ReasonNotAssigned:        "This coupon was issued to another customer.",
+	ReasonUserDenied:         "This coupon cannot be used on your account.",
+	ReasonRuleRejected:       "This coupon cannot be applied to your order.",
+	ReasonRuleError:          "This coupon could not be checked, please try again.",
+	ReasonCouponNotFound:     "This coupon code is not valid.",
+	ReasonRateLimited:        "Too many coupon attempts, please try again later.",
+}
+
+// Message returns the default human-readable message for the reason code
+func (r ReasonCode) Message() string {
+	if message, ok := reasonMessages[r]; ok {
+		return message
+	}
+	return reasonMessages[ReasonRuleRejected]
+}
+
+// Define a struct to represent the outcome of validating a coupon
+type ValidationResult struct {
+	CouponCode string
+	Valid      bool
+	Reason     ReasonCode
+	Message    string
+	Rule       string
+}
+
+// Build a result accepting the coupon
+func validResult(coupon Coupon) ValidationResult {
+	return ValidationResult{CouponCode: coupon.Code, Valid: true}
+}
+
+// Build a result rejecting the coupon for reason, using the default message when message is empty
+func invalidResult(coupon Coupon, reason ReasonCode, message, rule string) ValidationResult {
+	if message == "" {
+		message = reason.Message()
+	}
+	return ValidationResult{
+		CouponCode: coupon.Code,
+		Valid:      false,
+		Reason:     reason,
+		Message:    message,
+		Rule:       rule,
+	}
+}
+
+// Reject marks the coupon as not valid with a reason code and message. It is meant to
+// be called from GRL rules, e.g. Coupon.Reject("BELOW_MINIMUM", "Spend at least $50");
+func (c *Coupon) Reject(reason string, message string) {
+	c.IsValid = false
+	c.ReasonCode = reason
+	c.NotValidReason = message
+}
+
+// ruleOutcome builds the result of running rules against a coupon
+func ruleOutcome(coupon Coupon, rule string) ValidationResult {
+	if coupon.IsValid {
+		result := validResult(coupon)
+		result.Rule = rule
+		return result
+	}
+	reason := ReasonCode(coupon.ReasonCode)
+	if reason == ReasonNone {
+		reason = ReasonRuleRejected
+	}
+	return invalidResult(coupon, reason, coupon.NotValidReason, rule)
+}
+
+// validityTracker is a GruleEngineListener that remembers which rule last changed the
+// validity, rejection reason or rejection message of a coupon
+type validityTracker struct {
+	coupon      *Coupon
+	running     string
+	valid       bool
+	reason      string
+	message     string
+	responsible string
+}
+
+func newValidityTracker(coupon *Coupon) *validityTracker {
+	return &validityTracker{coupon: coupon, valid: coupon.IsValid, reason: coupon.ReasonCode, message: coupon.NotValidReason}
+}
+
+// settle attributes any change since the last snapshot to the rule that was running
+func (t *validityTracker) settle() {
+	if t.running != "" && (t.coupon.IsValid != t.valid || t.coupon.ReasonCode != t.reason || t.coupon.NotValidReason != t.message) {
+		t.responsible = t.running
+	}
+	t.valid = t.coupon.IsValid
+	t.reason = t.coupon.ReasonCode
+	t.message = t.coupon.NotValidReason
+}
+
+// restart forgets changes made since the last snapshot, after the facts were restored,
+// and makes decided the rule responsible for the outcome again
+func (t *validityTracker) restart(decided string) {
+	t.valid = t.coupon.IsValid
+	t.reason = t.coupon.ReasonCode
+	t.message = t.coupon.NotValidReason
+	t.running = ""
+	t.responsible = decided
+}
+
+func (t *validityTracker) EvaluateRuleEntry(cycle uint64, entry *ast.RuleEntry, candidate bool) {}
+
+func (t *validityTracker) ExecuteRuleEntry(cycle uint64, entry *ast.RuleEntry) {
+	t.settle()
+	t.running = entry.RuleName
+}
+
+func (t *validityTracker) BeginCycle(cycle uint64) {
+	t.settle()
+}
+
+// Define a struct to represent everything needed to validate a coupon for an order
+type ValidationRequest struct {
+	Coupon          Coupon
+	CustomerContext CustomerContext
+	ChangeContext   ChangeContext
+	OptionsContext  OptionsContext
+	Lines           []OrderLine
+	OrderTotal      float64
+	OrderTime       time.Time
+	OrderID         int
+	ShippingCountry string // ISO 3166-1 alpha-2 code of the shipping address
+	PaymentMethod   string
+	ClientIP        string
+	SessionID       string
+	SalesContext
+}
+
+// Total returns OrderTotal, or the sum of the order lines when no total was given
+func (r ValidationRequest) Total() float64 {
+	if r.OrderTotal != 0 || len(r.Lines) == 0 {
+		return r.OrderTotal
+	}
+	var cents int64
+	for _, line := range r.Lines {
+		cents += toCents(line.Total())
+	}
+	return fromCents(cents)
+}
+
+// Order returns the order facts handed to the rules
+func (r ValidationRequest) Order() OrderContext {
+	order := NewOrderContext(r.Lines, r.Total())
+	order.OrderID = r.OrderID
+	order.Channel = r.Channel
+	order.StoreID = r.StoreID
+	order.ShippingCountry = r.ShippingCountry
+	order.PaymentMethod = r.PaymentMethod
+	return order
+}
+
+// Time returns the moment the order is placed, defaulting to now
+func (r ValidationRequest) Time() time.Time {
+	if r.OrderTime.IsZero() {
+		return time.Now()
+	}
+	return r.OrderTime
+}
+
+// Define a struct to represent what the baseline checks need to know beyond the coupon
+// and its campaign
+type baselineFacts struct {
+	Used          int
+	UsedByUser    int
+	CampaignSpent float64
+	SKUIDs        []int
+	Assignment    CouponAssignment
+}
+
+// ValidateCoupon validates a coupon for an order. The intrinsic coupon and campaign
+// constraints are always enforced first; only a coupon passing them is handed to the
+// rulesets attached to it and to its campaign, which may still reject it.
+func ValidateCoupon(db *sql.DB, req ValidationRequest) (ValidationResult, error) {
+	coupon := req.Coupon
+
+	campaign, err := GetCampaignByID(db, coupon.CampaignID)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	coupon.Restrictions, err = GetCouponRestrictions(db, coupon.ID)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	facts, err := loadBaselineFacts(db, coupon, campaign, req.CustomerContext.UserID)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	req.CustomerContext.CouponUsageCount = facts.UsedByUser
+
+	result, err := checkBaseline(coupon, campaign, facts, req)
+	if err != nil || !result.Valid {
+		return result, err
+	}
+
+	rulesets, err := GetRulesetsForCoupon(db, coupon.ID, coupon.CampaignID)
+	if err != nil {
+		return ValidationResult{}, err
+	}
+
+	// Rules start from a coupon that passed the baseline and may only reject it
+	coupon.IsValid = true
+	coupon.ReasonCode = string(ReasonNone)
+	coupon.NotValidReason = ""
+	location, err := campaign.Location()
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	order := req.Order()
+	evaluation, err := DefaultRuleEngine.EvaluateFacts(rulesets, RuleFacts{
+		Coupon:          &coupon,
+		CustomerContext: &req.CustomerContext,
+		ChangeContext:   &req.ChangeContext,
+		OptionsContext:  &req.OptionsContext,
+		OrderContext:    &order,
+		Location:        location,
+		At:              req.Time(),
+	})
+	var rulesetErr *RulesetError
+	if errors.As(err, &rulesetErr) {
+		// A stored ruleset that no longer compiles rejects the coupon instead of failing validation
+		log.Printf("Error loading rulesets for coupon %s: %s", coupon.Code, err)
+		return invalidResult(coupon, ReasonRuleError, "", rulesetErr.Ruleset), nil
+	}
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	if evaluation.Err != nil {
+		log.Printf("Error validating coupon %s: %s", coupon.Code, evaluation.Err)
+	}
+	return evaluation.ValidationResult, nil
+}
+
+// Load the usage, budget, SKU and assignment facts the baseline checks need
+func loadBaselineFacts(db *sql.DB, coupon Coupon, campaign Campaign, userID int) (baselineFacts, error) {
+	var facts baselineFacts
+	var err error
+
+	facts.Used, err = CountCouponUsage(db, coupon.ID)
+	if err != nil {
+		return facts, err
+	}
+	facts.UsedByUser, err = CountUserCouponUsage(db, coupon.ID, userID, coupon.PerUserWindowDays)
+	if err != nil {
+		return facts, err
+	}
+	if campaign.Budget > 0 {
+		facts.CampaignSpent, err = GetCampaignBudgetSpent(db, campaign.ID)
+		if err != nil {
+			return facts, err
+		}
+	}
+	facts.SKUIDs, err = GetCouponSKUIDs(db, coupon.ID)
+	if err != nil {
+		return facts, err
+	}
+	facts.Assignment, err = GetCouponAssignment(db, coupon.ID, userID)
+	return facts, err
+}
+
+// ValidateCouponCode validates a coupon code entered by a customer. Attempts pass
+// through the limiter first so codes cannot be enumerated; a blocked attempt or an
+// unknown code is rejected without revealing anything about other coupons.
+func ValidateCouponCode(db *sql.DB, limiter *AttemptLimiter, code string, req ValidationRequest) (ValidationResult, error) {
+	unknown := Coupon{Code: code}
+
+	if limiter != nil {
+		decision, err := limiter.Allow(ValidationAttempt{UserID: req.CustomerContext.UserID, IP: req.ClientIP, SessionID: req.SessionID})
+		if err != nil {
+			return ValidationResult{}, err
+		}
+		if !decision.Allowed {
+			return invalidResult(unknown, ReasonRateLimited, "", ""), nil
+		}
+	}
+
+	coupon, err := GetCouponByCode(db, code)
+	if err == sql.ErrNoRows {
+		return invalidResult(unknown, ReasonCouponNotFound, "", ""), nil
+	}
+	if err != nil {
+		return ValidationResult{}, err
+	}
+
+	req.Coupon = coupon
+	return ValidateCoupon(db, req)
+}
+
+// checkBaseline enforces the constraints every coupon carries regardless of rulesets
+func checkBaseline(coupon Coupon, campaign Campaign, facts baselineFacts, req ValidationRequest) (ValidationResult, error) {
+	// Dates and windows are read in the campaign's time zone, at the moment of the order
+	location, err := campaign.Location()
+	if err != nil {
+		return ValidationResult{}, err
+	}
+	orderTime := req.Time().In(location)
+	orderDate := orderTime.Format(dateLayout)
+
+	if !coupon.IsActive {
+		return invalidResult(coupon, ReasonInactive, "", ""), nil
+	}
+	if reason := facts.Assignment.Check(); reason != ReasonNone {
+		return invalidResult(coupon, reason, "", ""), nil
+	}
+	if err := checkDate(coupon.ExpirationDate); err != nil {
+		return ValidationResult{}, fmt.Errorf("coupon %s: %w", coupon.Code, err)
+	}
+	if orderDate > coupon.ExpirationDate {
+		return invalidResult(coupon, ReasonExpired, "", ""), nil
+	}
+
+	if !campaign.IsActive {
+		return invalidResult(coupon, ReasonCampaignInactive, "", ""), nil
+	}
+	if err := checkDate(campaign.StartDate); err != nil {
+		return ValidationResult{}, fmt.Errorf("campaign %d: %w", campaign.ID, err)
+	}
+	if err := checkDate(campaign.EndDate); err != nil {
+		return ValidationResult{}, fmt.Errorf("campaign %d: %w", campaign.ID, err)
+	}
+	if orderDate < campaign.StartDate {
+		return invalidResult(coupon, ReasonCampaignNotStarted, "", ""), nil
+	}
+	if orderDate > campaign.EndDate {
+		return invalidResult(coupon, ReasonCampaignEnded, "", ""), nil
+	}
+	inside, err := inWindows(campaign.Windows, orderTime)
+	if err != nil {
+		return ValidationResult{}, fmt.Errorf("campaign %d: %w", campaign.ID, err)
+	}
+	if !inside {
+		return invalidResult(coupon, ReasonOutsideWindow, "", ""), nil
+	}
+
+	if campaign.Budget > 0 && toCents(facts.CampaignSpent) >= toCents(campaign.Budget) {
+		return invalidResult(coupon, ReasonBudgetExhausted, "", ""), nil
+	}
+
+	if reason := campaign.Restrictions.Check(req.SalesContext); reason != ReasonNone {
+		return invalidResult(coupon, reason, "", ""), nil
+	}
+	if reason := coupon.Restrictions.Check(req.SalesContext); reason != ReasonNone {
+		return invalidResult(coupon, reason, "", ""), nil
+	}
+
+	if toCents(req.Total()) < toCents(coupon.MinimumPurchase) {
+		return invalidResult(coupon, ReasonBelowMinimum, "", ""), nil
+	}
+
+	if limit := usageLimit(coupon.IsSingleUse, coupon.UsageLimit); limit > 0 && facts.Used >= limit {
+		return invalidResult(coupon, ReasonUsageExhausted, "", ""), nil
+	}
+	if coupon.PerUserLimit > 0 && facts.UsedByUser >= coupon.PerUserLimit {
+		return invalidResult(coupon, ReasonUserLimitReached, "", ""), nil
+	}
+
+	if len(facts.SKUIDs) > 0 && len(req.Lines) > 0 && !linesContainSKU(req.Lines, facts.SKUIDs) {
+		return invalidResult(coupon, ReasonNotEligibleSKU, "", ""), nil
+	}
+
+	return validResult(coupon), nil
+}
+
+// Check that a DATE column value is well formed
+func checkDate(value string) error {
+	if _, err := time.Parse(dateLayout, value); err != nil {
+		return fmt.Errorf("invalid date %q: %w", value, err)
+	}
+	return nil
+}
+
+// Report whether any order line holds one of the SKUs
+func linesContainSKU(lines []OrderLine, skuIDs []int) bool {
+	for _, line := range lines {
+		for _, skuID := range skuIDs {
+			if line.SKUID == skuID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Retrieve a coupon by its code
+func GetCouponByCode(db *sql.DB, code string) (Coupon, error) {
+	return scanCoupon(db.QueryRow("SELECT "+couponColumns+" FROM Coupons WHERE code = ?", code))
+}
+
+// Retrieve a coupon by ID
+func GetCouponByID(db *sql.DB, couponID int) (Coupon, error) {
+	return scanCoupon(db.QueryRow("SELECT "+couponColumns+" FROM Coupons WHERE id = ?", couponID))
+}
+
+// Columns of the Coupons table read by scanCoupon
+const couponColumns = "id, code, description, discount_type, discount_value, minimum_purchase, expiration_date, is_single_use, usage_limit, per_user_limit, per_user_window_days, is_active, reversal_policy, campaign_id"
+
+// Define an interface for a row, or rows, of a query that can be scanned
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Read a coupon selected with couponColumns
+func scanCoupon(row rowScanner) (Coupon, error) {
+	var coupon Coupon
+	err := row.Scan(&coupon.ID, &coupon.Code, &coupon.Description, &coupon.DiscountType, &coupon.DiscountValue, &coupon.MinimumPurchase, &coupon.ExpirationDate, &coupon.IsSingleUse, &coupon.UsageLimit, &coupon.PerUserLimit, &coupon.PerUserWindowDays, &coupon.IsActive, &coupon.ReversalPolicy, &coupon.CampaignID)
+	return coupon, err
+}
+
+// Select coupons with couponColumns, reading every row with scanCoupon. The query
+// follows the column list, e.g. "FROM Coupons WHERE campaign_id = ?".
+func queryCoupons(db *sql.DB, query string, args ...interface{}) ([]Coupon, error) {
+	rows, err := db.Query("SELECT "+couponColumns+" "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []Coupon
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// Retrieve a campaign by ID
+func GetCampaignByID(db *sql.DB, campaignID int) (Campaign, error) {
+	campaign := Campaign{ID: campaignID}
+	err := db.QueryRow("SELECT campaign_name, start_date, end_date, time_zone, is_active, budget, budget_policy FROM Campaigns WHERE id = ?", campaignID).
+		Scan(&campaign.Name, &campaign.StartDate, &campaign.EndDate, &campaign.TimeZone, &campaign.IsActive, &campaign.Budget, &campaign.BudgetPolicy)
+	if err != nil {
+		return campaign, err
+	}
+	campaign.Windows, err = GetCampaignWindows(db, campaignID)
+	if err != nil {
+		return campaign, err
+	}
+	campaign.Restrictions, err = GetCampaignRestrictions(db, campaignID)
+	return campaign, err
+}
+
+// Count how many times a coupon has been used or is held by an open reservation
+func CountCouponUsage(db queryer, couponID int) (int, error) {
+	var used int
+	err := db.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND "+activeUsageCondition, couponID).Scan(&used)
+	return used, err
+}
+
+// Count how many times a user has used a coupon, or holds it in an open reservation,
+// within the last windowDays days (ever when windowDays is 0)
+func CountUserCouponUsage(db queryer, couponID, userID, windowDays int) (int, error) {
+	var used int
+	var err error
+	if windowDays > 0 {
+		err = db.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND user_id = ? AND usage_date >= DATE_SUB(NOW(), INTERVAL ? DAY) AND "+activeUsageCondition,
+			couponID, userID, windowDays).Scan(&used)
+	} else {
+		err = db.QueryRow("SELECT COUNT(*) FROM CouponUsage WHERE coupon_id = ? AND user_id = ? AND "+activeUsageCondition,
+			couponID, userID).Scan(&used)
+	}
+	return used, err
+}
+
+// Retrieve the active versions of the rulesets attached to a campaign and to one of its
+// coupons, in evaluation order: campaign rulesets before coupon rulesets and, within
+// each, by position. Rulesets without an active version are skipped.
+func GetRulesetsForCoupon(db *sql.DB, couponID, campaignID int) ([]AttachedRuleset, error) {
+	rows, err := db.Query("SELECT r.name, v.version, v.definition, attached.scope, attached.mode FROM ("+
+		"SELECT 0 AS scope_order, 'campaign' AS scope, cr.ruleset_id, cr.mode, cr.position FROM Campaign_Rulesets cr WHERE cr.campaign_id = ? "+
+		"UNION ALL "+
+		"SELECT 1 AS scope_order, 'coupon' AS scope, cr.ruleset_id, cr.mode, cr.position FROM Coupon_Rulesets cr WHERE cr.coupon_id = ?"+
+		") attached JOIN Rulesets r ON r.id = attached.ruleset_id "+
+		"JOIN RulesetVersions v ON v.id = r.active_version_id ORDER BY attached.scope_order, attached.position, r.id",
+		campaignID, couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rulesets []AttachedRuleset
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var ruleset AttachedRuleset
+		if err := rows.Scan(&ruleset.Name, &ruleset.Version, &ruleset.Definition, &ruleset.Scope, &ruleset.Mode); err != nil {
+			return nil, err
+		}
+		// A ruleset attached to both the campaign and the coupon only runs once, as a campaign ruleset
+		if seen[ruleset.Name] {
+			continue
+		}
+		seen[ruleset.Name] = true
+		rulesets = append(rulesets, ruleset)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rulesets, nil
+}
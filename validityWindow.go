@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layout of the TIME columns used for recurring validity windows
+const clockLayout = "15:04"
+
+// Three-letter weekday names used to store recurring validity windows
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Define a struct to represent a recurring window a campaign is valid in, e.g. weekdays
+// 11:00-14:00. A window whose End is not after its Start runs past midnight into the
+// next day; Weekdays then name the day the window opens. No weekdays means every day.
+type ValidityWindow struct {
+	Weekdays []time.Weekday
+	Start    string
+	End      string
+}
+
+// Contains reports whether the local time falls inside the window
+func (w ValidityWindow) Contains(local time.Time) (bool, error) {
+	start, err := minutesOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := minutesOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+	now := local.Hour()*60 + local.Minute()
+
+	if start < end {
+		return w.opensOn(local.Weekday()) && now >= start && now < end, nil
+	}
+	// Overnight window: either the evening it opens or the morning after
+	if now >= start && w.opensOn(local.Weekday()) {
+		return true, nil
+	}
+	yesterday := local.AddDate(0, 0, -1).Weekday()
+	return now < end && w.opensOn(yesterday), nil
+}
+
+// Report whether the window opens on the weekday
+func (w ValidityWindow) opensOn(day time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, weekday := range w.Weekdays {
+		if weekday == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert an HH:MM (or HH:MM:SS) clock time to minutes after midnight
+func minutesOfDay(clock string) (int, error) {
+	if len(clock) > len(clockLayout) {
+		clock = clock[:len(clockLayout)]
+	}
+	parsed, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", clock, err)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Parse a comma-separated list of weekday names such as "mon,tue,wed"
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var weekdays []time.Weekday
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weekday, ok := weekdayNames[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", name)
+		}
+		weekdays = append(weekdays, weekday)
+	}
+	return weekdays, nil
+}
+
+// Location returns the time zone the campaign's dates and windows are expressed in,
+// defaulting to UTC
+func (c Campaign) Location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("campaign %d: invalid time zone %q: %w", c.ID, c.TimeZone, err)
+	}
+	return location, nil
+}
+
+// inWindows reports whether the local time falls inside any of the windows; no windows
+// means the campaign is valid all day
+func inWindows(windows []ValidityWindow, local time.Time) (bool, error) {
+	if len(windows) == 0 {
+		return true, nil
+	}
+	for _, window := range windows {
+		inside, err := window.Contains(local)
+		if err != nil || inside {
+			return inside, err
+		}
+	}
+	return false, nil
+}
+
+// Retrieve the recurring validity windows of a campaign
+func GetCampaignWindows(db *sql.DB, campaignID int) ([]ValidityWindow, error) {
+	rows, err := db.Query("SELECT weekdays, start_time, end_time FROM Campaign_Windows WHERE campaign_id = ? ORDER BY id", campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []ValidityWindow
+	for rows.Next() {
+		var weekdays string
+		var window ValidityWindow
+		if err := rows.Scan(&weekdays, &window.Start, &window.End); err != nil {
+			return nil, err
+		}
+		window.Weekdays, err = parseWeekdays(weekdays)
+		if err != nil {
+			return nil, fmt.Errorf("campaign %d: %w", campaignID, err)
+		}
+		windows = append(windows, window)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+// Insert a recurring validity window for a campaign
+func InsertCampaignWindow(db execer, campaignID int, window ValidityWindow) error {
+	for _, clock := range []string{window.Start, window.End} {
+		if _, err := minutesOfDay(clock); err != nil {
+			return fmt.Errorf("campaign %d: %w", campaignID, err)
+		}
+	}
+	weekdays := make([]string, len(window.Weekdays))
+	for i, weekday := range window.Weekdays {
+		weekdays[i] = strings.ToLower(weekday.String()[:3])
+	}
+	_, err := db.Exec("INSERT INTO Campaign_Windows (campaign_id, weekdays, start_time, end_time) VALUES (?, ?, ?, ?)",
+		campaignID, strings.Join(weekdays, ","), window.Start, window.End)
+	return err
+}
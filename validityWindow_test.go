@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInsertCampaignSavesWindowsAndRestrictions(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now()
+	campaign := Campaign{
+		Name:      "window test",
+		StartDate: now.Format(dateLayout),
+		EndDate:   now.AddDate(0, 0, 30).Format(dateLayout),
+		TimeZone:  "America/New_York",
+		IsActive:  true,
+		Windows: []ValidityWindow{
+			{Weekdays: []time.Weekday{time.Monday, time.Friday}, Start: "11:00", End: "14:00"},
+			{Start: "22:00", End: "02:00"},
+		},
+		Restrictions: Restrictions{Channels: []string{ChannelWeb}, StoreIDs: []int{7}, Regions: []string{"US-CA"}},
+	}
+	campaignID, err := InsertCampaign(db, campaign)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := GetCampaignByID(db, campaignID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Windows) != 2 || !reflect.DeepEqual(saved.Windows[0].Weekdays, campaign.Windows[0].Weekdays) ||
+		saved.Windows[1].Weekdays != nil || saved.Windows[0].Start[:5] != "11:00" || saved.Windows[1].End[:5] != "02:00" {
+		t.Errorf("got windows %+v, want %+v", saved.Windows, campaign.Windows)
+	}
+	if !reflect.DeepEqual(saved.Restrictions, campaign.Restrictions) {
+		t.Errorf("got restrictions %+v, want %+v", saved.Restrictions, campaign.Restrictions)
+	}
+
+	campaign.Windows = []ValidityWindow{{Start: "25:00", End: "02:00"}}
+	if _, err := InsertCampaign(db, campaign); err == nil {
+		t.Error("a window with an invalid time was saved")
+	}
+}
+
+func TestValidityWindowContains(t *testing.T) {
+	// 2024-01-05 is a Friday
+	at := func(day int, clock string) time.Time {
+		parsed, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, time.January, day, parsed.Hour(), parsed.Minute(), 0, 0, time.UTC)
+	}
+	lunch := ValidityWindow{Weekdays: []time.Weekday{time.Friday}, Start: "11:00", End: "14:00"}
+	overnight := ValidityWindow{Weekdays: []time.Weekday{time.Friday}, Start: "22:00", End: "02:00"}
+	tests := []struct {
+		name   string
+		window ValidityWindow
+		local  time.Time
+		want   bool
+	}{
+		{"inside", lunch, at(5, "12:30"), true},
+		{"at the start", lunch, at(5, "11:00"), true},
+		{"at the end", lunch, at(5, "14:00"), false},
+		{"other weekday", lunch, at(4, "12:30"), false},
+		{"every day", ValidityWindow{Start: "11:00", End: "14:00"}, at(4, "12:30"), true},
+		{"overnight evening", overnight, at(5, "23:30"), true},
+		{"overnight after midnight", overnight, at(6, "01:30"), true},
+		{"overnight closed in the morning", overnight, at(6, "02:00"), false},
+		{"overnight before opening", overnight, at(5, "21:59"), false},
+		{"overnight morning after another day", overnight, at(5, "01:30"), false},
+		{"overnight evening of another day", overnight, at(6, "23:30"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.window.Contains(test.local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := (ValidityWindow{Start: "noon", End: "14:00"}).Contains(at(5, "12:00")); err == nil {
+		t.Error("an invalid start time was accepted")
+	}
+}